@@ -0,0 +1,254 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	cb "github.com/clearblade/Go-SDK"
+	mqtt "github.com/clearblade/paho.mqtt.golang"
+	"github.com/clearblade/paho.mqtt.golang/packets"
+)
+
+const (
+	authTypeDevice    = "device"    // device name and active key
+	authTypeUser      = "user"      // user email and password
+	authTypeDeveloper = "developer" // developer email and password
+	authTypeToken     = "token"     // pre-issued token, can't be refreshed
+)
+
+var (
+	authMutex            sync.Mutex
+	otherCbClient        cb.Client
+	otherCbUsername      string // token derived from authenticating with the external ClearBlade system
+	otherCbPassword      string
+	tokenRefreshInterval time.Duration
+)
+
+// cbCredentials describes how to authenticate with a ClearBlade system
+type cbCredentials struct {
+	AuthType     string
+	PlatformURL  string
+	MessagingURL string
+	SystemKey    string
+	SystemSecret string
+	Name         string // device name for device auth, email for user and developer auth
+	Secret       string // active key for device auth, password for user and developer auth
+	Token        string // token for token auth
+}
+
+// validate returns an error describing what is missing for the auth type
+func (c cbCredentials) validate() error {
+	var missing []string
+	require := func(value, name string) {
+		if value == "" {
+			missing = append(missing, name)
+		}
+	}
+
+	switch c.AuthType {
+	case authTypeDevice:
+		require(c.SystemKey, "system key")
+		require(c.SystemSecret, "system secret")
+		require(c.Name, "device name")
+		require(c.Secret, "active key")
+	case authTypeUser:
+		require(c.SystemKey, "system key")
+		require(c.SystemSecret, "system secret")
+		require(c.Name, "email")
+		require(c.Secret, "password")
+	case authTypeDeveloper:
+		require(c.SystemKey, "system key")
+		require(c.Name, "email")
+		require(c.Secret, "password")
+	case authTypeToken:
+		require(c.SystemKey, "system key")
+		require(c.Token, "token")
+	default:
+		return fmt.Errorf("unknown auth type %s, expected one of device, user, developer or token", c.AuthType)
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("%s auth requires %s", c.AuthType, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// newCbClient creates a ClearBlade client for the auth type, it still needs to be authenticated with authenticateCbClient
+func newCbClient(c cbCredentials) cb.Client {
+	switch c.AuthType {
+	case authTypeUser:
+		return cb.NewUserClientWithAddrs(c.PlatformURL, c.MessagingURL, c.SystemKey, c.SystemSecret, c.Name, c.Secret)
+	case authTypeDeveloper:
+		return cb.NewDevClientWithAddrs(c.PlatformURL, c.MessagingURL, c.Name, c.Secret)
+	case authTypeToken:
+		client := cb.NewUserClientWithAddrs(c.PlatformURL, c.MessagingURL, c.SystemKey, c.SystemSecret, "", "")
+		client.UserToken = c.Token
+		return client
+	default:
+		return cb.NewDeviceClientWithAddrs(c.PlatformURL, c.MessagingURL, c.SystemKey, c.SystemSecret, c.Name, c.Secret)
+	}
+}
+
+// authenticateCbClient gets a new token for the client, pre-issued tokens can't be refreshed so they are left as is
+func authenticateCbClient(client cb.Client) error {
+	var err error
+	switch c := client.(type) {
+	case *cb.DeviceClient:
+		_, err = c.Authenticate()
+	case *cb.UserClient:
+		if c.Email == "" {
+			log.Println("[WARN] authenticateCbClient - Pre-issued tokens can't be refreshed, keeping current token")
+			return nil
+		}
+		_, err = c.Authenticate()
+	case *cb.DevClient:
+		_, err = c.Authenticate()
+	default:
+		err = fmt.Errorf("unsupported ClearBlade client type %T", client)
+	}
+	return err
+}
+
+// cbClientToken returns the token of an authenticated client, which is used as the MQTT username
+func cbClientToken(client cb.Client) string {
+	switch c := client.(type) {
+	case *cb.DeviceClient:
+		return c.DeviceToken
+	case *cb.UserClient:
+		return c.UserToken
+	case *cb.DevClient:
+		return c.DevToken
+	}
+	return ""
+}
+
+// isAuthError reports whether a connect failed because the broker rejected our credentials
+func isAuthError(token mqtt.Token) bool {
+	connectToken, ok := token.(*mqtt.ConnectToken)
+	if !ok {
+		return false
+	}
+	code := connectToken.ReturnCode()
+	return code == packets.ErrRefusedBadUsernameOrPassword || code == packets.ErrRefusedNotAuthorised
+}
+
+// setCbClient replaces the ClearBlade device client, which the token refresher and telemetry use concurrently
+func setCbClient(client cb.Client) {
+	authMutex.Lock()
+	defer authMutex.Unlock()
+	cbClient = client
+}
+
+// currentCbClient returns the ClearBlade device client
+func currentCbClient() cb.Client {
+	authMutex.Lock()
+	defer authMutex.Unlock()
+	return cbClient
+}
+
+// refreshCbToken re-authenticates the ClearBlade device client so REST calls and the next MQTT connect use a valid token
+func refreshCbToken() error {
+	authMutex.Lock()
+	defer authMutex.Unlock()
+
+	if cbClient == nil {
+		return nil
+	}
+	log.Println("[INFO] refreshCbToken - Re-authenticating with ClearBlade")
+	return authenticateCbClient(cbClient)
+}
+
+// refreshOtherCbToken re-authenticates with the external ClearBlade system and updates the credentials
+// used the next time we connect to it
+func refreshOtherCbToken() error {
+	authMutex.Lock()
+	defer authMutex.Unlock()
+
+	if !currentConfig().BrokerConfig.IsCbBroker || otherCbClient == nil {
+		return nil
+	}
+	log.Println("[INFO] refreshOtherCbToken - Re-authenticating with external ClearBlade system")
+	if err := authenticateCbClient(otherCbClient); err != nil {
+		return err
+	}
+	otherCbUsername = cbClientToken(otherCbClient)
+	otherCbPassword = currentConfig().BrokerConfig.SystemKey
+	return nil
+}
+
+// setOtherCbClient stores an authenticated external ClearBlade client and the MQTT credentials derived from it
+func setOtherCbClient(client cb.Client) {
+	authMutex.Lock()
+	defer authMutex.Unlock()
+
+	otherCbClient = client
+	otherCbUsername = cbClientToken(client)
+	otherCbPassword = currentConfig().BrokerConfig.SystemKey
+}
+
+// parentCredentials returns the credentials given on the command line
+func parentCredentials() cbCredentials {
+	creds := cbCredentials{
+		AuthType:     authType,
+		PlatformURL:  platformURL,
+		MessagingURL: messagingURL,
+		SystemKey:    sysKey,
+		SystemSecret: sysSec,
+		Name:         deviceName,
+		Secret:       activeKey,
+		Token:        token,
+	}
+	if authType == authTypeUser || authType == authTypeDeveloper {
+		creds.Name = email
+	}
+	return creds
+}
+
+// otherCredentials returns the credentials for the external ClearBlade system from adapter_settings
+func otherCredentials(b mqttBroker) cbCredentials {
+	creds := cbCredentials{
+		AuthType:     b.AuthType,
+		PlatformURL:  b.PlatformURL,
+		MessagingURL: b.MessagingURL,
+		SystemKey:    b.SystemKey,
+		SystemSecret: b.SystemSecret,
+		Name:         b.DeviceName,
+		Secret:       b.ActiveKey,
+		Token:        b.Token,
+	}
+	if creds.AuthType == "" {
+		creds.AuthType = authTypeDevice
+	}
+	if creds.AuthType == authTypeUser || creds.AuthType == authTypeDeveloper {
+		creds.Name = b.Email
+		creds.Secret = b.Password
+	}
+	return creds
+}
+
+// otherCbCredentials returns the MQTT username and password derived from the external ClearBlade token
+func otherCbCredentials() (string, string) {
+	authMutex.Lock()
+	defer authMutex.Unlock()
+
+	return otherCbUsername, otherCbPassword
+}
+
+// tokenRefresher re-authenticates both sides before their tokens expire
+func tokenRefresher() {
+	if tokenRefreshInterval <= 0 {
+		return
+	}
+	for {
+		time.Sleep(tokenRefreshInterval)
+		if err := refreshCbToken(); err != nil {
+			log.Printf("[ERROR] tokenRefresher - Failed to refresh ClearBlade token: %s\n", err.Error())
+		}
+		if err := refreshOtherCbToken(); err != nil {
+			log.Printf("[ERROR] tokenRefresher - Failed to refresh external ClearBlade token: %s\n", err.Error())
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	codecCBOR    = "cbor"
+	codecMsgpack = "msgpack"
+)
+
+var cborDecMode, _ = cbor.DecOptions{
+	BigIntDec: cbor.BigIntDecodePointer, // *big.Int marshals to a JSON number, big.Int doesn't
+}.DecMode()
+
+// decodePayload converts incoming payloads on routes with a codec from the binary format to JSON, so ClearBlade
+// services only ever see JSON
+func decodePayload(msg *bridgeMessage) error {
+	if msg.Direction != directionIncoming {
+		return nil
+	}
+	route := findRoute(msg.Direction, msg.Topic)
+	if route == nil || route.Codec == "" {
+		return nil
+	}
+
+	var document interface{}
+	var err error
+	switch route.Codec {
+	case codecCBOR:
+		err = cborDecMode.Unmarshal(msg.Payload, &document)
+	case codecMsgpack:
+		decoder := msgpack.NewDecoder(bytes.NewReader(msg.Payload))
+		decoder.SetMapDecoder(func(d *msgpack.Decoder) (interface{}, error) {
+			return d.DecodeUntypedMap()
+		})
+		document, err = decoder.DecodeInterface()
+	}
+	if err != nil {
+		return fmt.Errorf("unable to decode %s payload: %s", route.Codec, err.Error())
+	}
+
+	payload, err := json.Marshal(jsonValue(document))
+	if err != nil {
+		return fmt.Errorf("unable to convert %s payload to JSON: %s", route.Codec, err.Error())
+	}
+	msg.Payload = payload
+	msg.Transforms = append(msg.Transforms, "decode")
+	return nil
+}
+
+// encodePayload converts outgoing JSON payloads on routes with a codec to the binary format
+func encodePayload(msg *bridgeMessage) error {
+	if msg.Direction != directionOutgoing {
+		return nil
+	}
+	route := findRoute(msg.Direction, msg.Topic)
+	if route == nil || route.Codec == "" {
+		return nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(msg.Payload))
+	decoder.UseNumber()
+	var document interface{}
+	if err := decoder.Decode(&document); err != nil {
+		return fmt.Errorf("payload is not valid JSON: %s", err.Error())
+	}
+	document, err := binaryValue(document)
+	if err != nil {
+		return err
+	}
+
+	var payload []byte
+	switch route.Codec {
+	case codecCBOR:
+		payload, err = cbor.Marshal(document)
+	case codecMsgpack:
+		var buffer bytes.Buffer
+		encoder := msgpack.NewEncoder(&buffer)
+		encoder.UseCompactInts(true)
+		err = encoder.Encode(document)
+		payload = buffer.Bytes()
+	}
+	if err != nil {
+		return fmt.Errorf("unable to encode payload as %s: %s", route.Codec, err.Error())
+	}
+	msg.Payload = payload
+	msg.Transforms = append(msg.Transforms, route.Codec)
+	return nil
+}
+
+// jsonValue converts a decoded CBOR or MessagePack value to one encoding/json can marshal. Maps with non string
+// keys use the key's text, byte strings become base64 strings, timestamps are in UTC and the content of unknown
+// CBOR tags is kept
+func jsonValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		object := make(map[string]interface{}, len(v))
+		for key, field := range v {
+			object[jsonKey(key)] = jsonValue(field)
+		}
+		return object
+	case map[string]interface{}:
+		for key, field := range v {
+			v[key] = jsonValue(field)
+		}
+		return v
+	case []interface{}:
+		for i, element := range v {
+			v[i] = jsonValue(element)
+		}
+		return v
+	case cbor.Tag:
+		return jsonValue(v.Content)
+	case time.Time:
+		return v.UTC()
+	}
+	// []byte is marshalled as a base64 string, and integers of every width as exact JSON numbers
+	return value
+}
+
+func jsonKey(key interface{}) string {
+	switch k := key.(type) {
+	case string:
+		return k
+	case []byte:
+		return string(k)
+	}
+	return fmt.Sprint(key)
+}
+
+// binaryValue replaces the json.Numbers in a decoded JSON document with int64 or uint64 for integers, so they
+// don't lose precision as floats and are encoded at the smallest width that holds them, and float64 otherwise
+func binaryValue(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			converted, err := binaryValue(field)
+			if err != nil {
+				return nil, err
+			}
+			v[key] = converted
+		}
+	case []interface{}:
+		for i, element := range v {
+			converted, err := binaryValue(element)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = converted
+		}
+	case json.Number:
+		if n, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+			return n, nil
+		}
+		if n, err := strconv.ParseUint(string(v), 10, 64); err == nil {
+			return n, nil
+		}
+		n, err := strconv.ParseFloat(string(v), 64)
+		if err != nil {
+			return nil, fmt.Errorf("number %s can't be represented: %s", v, err.Error())
+		}
+		return n, nil
+	}
+	return value, nil
+}
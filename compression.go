@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	compressionGzip   = "gzip"
+	compressionZstd   = "zstd"
+	compressionSnappy = "snappy"
+
+	compressionMarkerSuffix   = "suffix"
+	compressionMarkerEnvelope = "envelope"
+
+	// limits how large a decompressed payload can get, so a small payload can't exhaust memory
+	maxDecompressedBytes = 64 << 20
+)
+
+var (
+	compressionAlgorithms = []string{compressionGzip, compressionZstd, compressionSnappy}
+
+	// EncodeAll and DecodeAll can be used concurrently
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxDecompressedBytes))
+)
+
+// compressionEnvelope wraps a compressed payload when a route uses the envelope marker
+type compressionEnvelope struct {
+	Compression string `json:"compression"`
+	Payload     []byte `json:"payload"` // base64 encoded in the JSON
+}
+
+// compressPayload compresses outgoing payloads on routes with compression, marking the message with a topic
+// suffix (a header in Kafka and HTTP mode, see publishOutgoing) or an envelope so the consumer knows how to
+// decompress it
+func compressPayload(msg *bridgeMessage) error {
+	if msg.Direction != directionOutgoing {
+		return nil
+	}
+	route := findRoute(msg.Direction, msg.Topic)
+	if route == nil || route.Compression == "" {
+		return nil
+	}
+	compressed, err := compress(route.Compression, msg.Payload)
+	if err != nil {
+		return fmt.Errorf("unable to %s compress payload: %s", route.Compression, err.Error())
+	}
+	addStat(statCompressionBytesIn, uint64(len(msg.Payload)))
+	addStat(statCompressionBytesOut, uint64(len(compressed)))
+
+	if route.CompressionMarker == compressionMarkerEnvelope {
+		if compressed, err = json.Marshal(compressionEnvelope{Compression: route.Compression, Payload: compressed}); err != nil {
+			return err
+		}
+	} else {
+		msg.Compression = route.Compression
+	}
+	msg.Payload = compressed
+	msg.Transforms = append(msg.Transforms, route.Compression)
+	return nil
+}
+
+// decompressPayload decompresses incoming payloads on routes with compression that are marked as compressed,
+// removing the topic suffix, header or envelope. Unmarked payloads are left unchanged
+func decompressPayload(msg *bridgeMessage) error {
+	if msg.Direction != directionIncoming {
+		return nil
+	}
+
+	payload := msg.Payload
+	algorithm, topic := markedCompression(msg)
+	if route := findRoute(msg.Direction, topic); algorithm == "" || route == nil || route.Compression != algorithm ||
+		route.CompressionMarker == compressionMarkerEnvelope {
+		// not marked with a suffix or header, check for an envelope
+		route = findRoute(msg.Direction, msg.Topic)
+		if route == nil || route.Compression == "" || route.CompressionMarker != compressionMarkerEnvelope {
+			return nil
+		}
+		var envelope compressionEnvelope
+		if err := json.Unmarshal(msg.Payload, &envelope); err != nil || envelope.Compression != route.Compression {
+			return nil
+		}
+		algorithm, topic, payload = envelope.Compression, msg.Topic, envelope.Payload
+	}
+
+	decompressed, err := decompress(algorithm, payload)
+	if err != nil {
+		return fmt.Errorf("unable to %s decompress payload: %s", algorithm, err.Error())
+	}
+	msg.Topic = topic
+	msg.Payload = decompressed
+	msg.Compression = ""
+	msg.Transforms = append(msg.Transforms, "decompress")
+	return nil
+}
+
+// markedCompression returns the algorithm a message is marked as compressed with by a header or topic suffix, and
+// the topic without the suffix
+func markedCompression(msg *bridgeMessage) (string, string) {
+	if msg.Compression != "" {
+		return msg.Compression, msg.Topic
+	}
+	for _, algorithm := range compressionAlgorithms {
+		if strings.HasSuffix(msg.Topic, "/"+algorithm) {
+			return algorithm, strings.TrimSuffix(msg.Topic, "/"+algorithm)
+		}
+	}
+	return "", msg.Topic
+}
+
+func compress(algorithm string, payload []byte) ([]byte, error) {
+	switch algorithm {
+	case compressionGzip:
+		var buffer bytes.Buffer
+		writer := gzip.NewWriter(&buffer)
+		if _, err := writer.Write(payload); err != nil {
+			return nil, err
+		}
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+		return buffer.Bytes(), nil
+	case compressionZstd:
+		return zstdEncoder.EncodeAll(payload, nil), nil
+	case compressionSnappy:
+		return snappy.Encode(nil, payload), nil
+	}
+	return nil, fmt.Errorf("unknown compression %s", algorithm)
+}
+
+func decompress(algorithm string, payload []byte) ([]byte, error) {
+	switch algorithm {
+	case compressionGzip:
+		reader, err := gzip.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		decompressed, err := io.ReadAll(io.LimitReader(reader, maxDecompressedBytes+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(decompressed) > maxDecompressedBytes {
+			return nil, fmt.Errorf("decompressed payload is larger than %d bytes", maxDecompressedBytes)
+		}
+		return decompressed, nil
+	case compressionZstd:
+		return zstdDecoder.DecodeAll(payload, nil)
+	case compressionSnappy:
+		if length, err := snappy.DecodedLen(payload); err != nil {
+			return nil, err
+		} else if length > maxDecompressedBytes {
+			return nil, fmt.Errorf("decompressed payload is larger than %d bytes", maxDecompressedBytes)
+		}
+		return snappy.Decode(nil, payload)
+	}
+	return nil, fmt.Errorf("unknown compression %s", algorithm)
+}
+
+// compressionRatio returns the size of compressed payloads as a fraction of their original size
+func compressionRatio(bytesIn, bytesOut uint64) float64 {
+	if bytesIn == 0 {
+		return 0
+	}
+	return float64(bytesOut) / float64(bytesIn)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	mqtt "github.com/clearblade/paho.mqtt.golang"
+)
+
+// created in main, the connect functions refer back to them through the connection handlers
+var (
+	cbConnection    *connectionManager
+	otherConnection *connectionManager
+)
+
+// connectionManager owns the MQTT client and message listener for one side of the bridge. Reconnecting always
+// tears down the previous client and listener first, so there is never more than one of each
+type connectionManager struct {
+	sync.Mutex
+	name           string
+	connect        func() (mqtt.Client, error)
+	client         mqtt.Client
+	connecting     bool
+	cancelListener context.CancelFunc
+	listenerDone   chan struct{}
+}
+
+func newConnectionManager(name string, connect func() (mqtt.Client, error)) *connectionManager {
+	return &connectionManager{name: name, connect: connect}
+}
+
+// restart disconnects the current client, waiting quiesce milliseconds for in flight work, and connects a new
+// one, trying again every retryInterval until it succeeds. It returns false without doing anything if the
+// connection is already being restarted
+func (m *connectionManager) restart(retryInterval time.Duration, quiesce uint) bool {
+	m.Lock()
+	if m.connecting {
+		m.Unlock()
+		return false
+	}
+	m.connecting = true
+	previous := m.client
+	m.client = nil
+	m.stopListenerLocked()
+	m.Unlock()
+
+	if previous != nil {
+		previous.Disconnect(quiesce)
+	}
+
+	var client mqtt.Client
+	for {
+		var err error
+		if client, err = m.connect(); err == nil {
+			break
+		}
+		log.Printf("[ERROR] connectionManager - Failed to connect %s client, trying again in %s\n", m.name, retryInterval)
+		time.Sleep(retryInterval)
+	}
+
+	m.Lock()
+	m.client = client
+	m.connecting = false
+	m.Unlock()
+
+	// the connection lost handler ignores clients that aren't current yet, so check we didn't miss it
+	if !client.IsConnected() {
+		time.Sleep(retryInterval)
+		m.connectionLost(client, retryInterval)
+	}
+	return true
+}
+
+// connectionLost reconnects if client is the current client, stale clients are ignored
+func (m *connectionManager) connectionLost(client mqtt.Client, retryInterval time.Duration) bool {
+	m.Lock()
+	current := m.client == client
+	m.Unlock()
+	if !current {
+		log.Printf("[DEBUG] connectionManager - Ignoring connection lost from a previous %s client\n", m.name)
+		return false
+	}
+	return m.restart(retryInterval, 0)
+}
+
+// startListener stops the current listener, waiting for it to return, and starts listener in its place
+func (m *connectionManager) startListener(listener func(ctx context.Context)) {
+	m.Lock()
+	defer m.Unlock()
+	m.stopListenerLocked()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	m.cancelListener, m.listenerDone = cancel, done
+	go func() {
+		defer close(done)
+		listener(ctx)
+	}()
+}
+
+func (m *connectionManager) stopListenerLocked() {
+	if m.cancelListener == nil {
+		return
+	}
+	m.cancelListener()
+	<-m.listenerDone
+	m.cancelListener, m.listenerDone = nil, nil
+}
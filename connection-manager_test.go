@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	mqtt "github.com/clearblade/paho.mqtt.golang"
+)
+
+// fakeClient implements the parts of mqtt.Client used by connectionManager
+type fakeClient struct {
+	mqtt.Client
+	sync.Mutex
+	connected    bool
+	disconnected int
+}
+
+func (c *fakeClient) IsConnected() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.connected
+}
+
+func (c *fakeClient) Disconnect(quiesce uint) {
+	c.Lock()
+	defer c.Unlock()
+	c.connected = false
+	c.disconnected++
+}
+
+// fakeConnection creates connected fake clients and, like the connect handlers, starts a listener for each one
+type fakeConnection struct {
+	sync.Mutex
+	manager        *connectionManager
+	clients        []*fakeClient
+	listeners      int32
+	maxListeners   int32
+	listenersStart int32
+}
+
+func newFakeConnection() *fakeConnection {
+	f := &fakeConnection{}
+	f.manager = newConnectionManager("fake", f.connect)
+	return f
+}
+
+func (f *fakeConnection) connect() (mqtt.Client, error) {
+	client := &fakeClient{connected: true}
+	f.Lock()
+	f.clients = append(f.clients, client)
+	f.Unlock()
+	f.manager.startListener(f.listen)
+	return client, nil
+}
+
+func (f *fakeConnection) listen(ctx context.Context) {
+	atomic.AddInt32(&f.listenersStart, 1)
+	running := atomic.AddInt32(&f.listeners, 1)
+	for {
+		max := atomic.LoadInt32(&f.maxListeners)
+		if running <= max || atomic.CompareAndSwapInt32(&f.maxListeners, max, running) {
+			break
+		}
+	}
+	<-ctx.Done()
+	atomic.AddInt32(&f.listeners, -1)
+}
+
+func (f *fakeConnection) current() *fakeClient {
+	f.Lock()
+	defer f.Unlock()
+	return f.clients[len(f.clients)-1]
+}
+
+// waitForCount waits for a counter updated by a listener goroutine to reach want, returning the last value
+func waitForCount(counter *int32, want int32) int32 {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		value := atomic.LoadInt32(counter)
+		if value == want || time.Now().After(deadline) {
+			return value
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// waitForGoroutines waits for the number of goroutines to drop to at most want, returning the last count
+func waitForGoroutines(want int) int {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		count := runtime.NumGoroutine()
+		if count <= want || time.Now().After(deadline) {
+			return count
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestConnectionManagerRestartsWithoutLeakingGoroutines(t *testing.T) {
+	f := newFakeConnection()
+	f.manager.restart(time.Millisecond, 0)
+	baseline := runtime.NumGoroutine()
+
+	for i := 0; i < 100; i++ {
+		if i%2 == 0 {
+			if !f.manager.restart(time.Millisecond, 0) {
+				t.Fatalf("restart %d: restart returned false with no restart in progress", i)
+			}
+		} else if !f.manager.connectionLost(f.current(), time.Millisecond) {
+			t.Fatalf("restart %d: connectionLost ignored the current client", i)
+		}
+	}
+
+	if count := waitForGoroutines(baseline); count > baseline {
+		t.Errorf("goroutines grew from %d to %d over 100 restarts", baseline, count)
+	}
+	if max := atomic.LoadInt32(&f.maxListeners); max != 1 {
+		t.Errorf("expected at most one listener running at a time, %d were running", max)
+	}
+	if running := waitForCount(&f.listeners, 1); running != 1 {
+		t.Errorf("expected one listener running after the restarts, %d are running", running)
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	for i, client := range f.clients[:len(f.clients)-1] {
+		if client.disconnected != 1 {
+			t.Errorf("client %d was disconnected %d times, expected once", i, client.disconnected)
+		}
+	}
+	if current := f.clients[len(f.clients)-1]; current.disconnected != 0 || !current.connected {
+		t.Errorf("the current client should still be connected")
+	}
+}
+
+func TestConnectionManagerIgnoresStaleClients(t *testing.T) {
+	f := newFakeConnection()
+	f.manager.restart(time.Millisecond, 0)
+	stale := f.current()
+	f.manager.restart(time.Millisecond, 0)
+	current := f.current()
+
+	if f.manager.connectionLost(stale, time.Millisecond) {
+		t.Fatal("connectionLost restarted the connection for a client that had already been replaced")
+	}
+	if f.current() != current || current.disconnected != 0 {
+		t.Error("connectionLost for a stale client replaced the current client")
+	}
+	if starts := waitForCount(&f.listenersStart, 2); starts != 2 {
+		t.Errorf("expected 2 listeners to have been started, %d were", starts)
+	}
+}
+
+func TestConnectionManagerIgnoresRestartWhileConnecting(t *testing.T) {
+	release := make(chan struct{})
+	manager := newConnectionManager("fake", func() (mqtt.Client, error) {
+		<-release
+		return &fakeClient{connected: true}, nil
+	})
+
+	done := make(chan bool)
+	go func() { done <- manager.restart(time.Millisecond, 0) }()
+
+	// wait for the first restart to be connecting
+	for {
+		manager.Lock()
+		connecting := manager.connecting
+		manager.Unlock()
+		if connecting {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if manager.restart(time.Millisecond, 0) {
+		t.Error("a second restart ran while the first was still connecting")
+	}
+	close(release)
+	if !<-done {
+		t.Error("the first restart returned false")
+	}
+}
+
+func TestStartListenerStopsThePreviousListener(t *testing.T) {
+	manager := newConnectionManager("fake", nil)
+	var running, overlaps int32
+	listener := func(ctx context.Context) {
+		if atomic.AddInt32(&running, 1) > 1 {
+			atomic.AddInt32(&overlaps, 1)
+		}
+		<-ctx.Done()
+		// give a listener started too early a chance to overlap
+		time.Sleep(time.Millisecond)
+		atomic.AddInt32(&running, -1)
+	}
+
+	baseline := runtime.NumGoroutine()
+	for i := 0; i < 50; i++ {
+		manager.startListener(listener)
+	}
+	manager.Lock()
+	manager.stopListenerLocked()
+	manager.Unlock()
+
+	if overlaps := atomic.LoadInt32(&overlaps); overlaps != 0 {
+		t.Errorf("a listener started before the previous one returned %d times", overlaps)
+	}
+	if running := atomic.LoadInt32(&running); running != 0 {
+		t.Errorf("%d listeners still running after stopping", running)
+	}
+	if count := waitForGoroutines(baseline); count > baseline {
+		t.Errorf("goroutines grew from %d to %d", baseline, count)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+	"time"
+)
+
+const (
+	directionOutgoing = "outgoing" // ClearBlade to external
+	directionIncoming = "incoming" // external to ClearBlade
+)
+
+// deadLetter is the envelope published to the dead letter topic for messages that could not be forwarded
+type deadLetter struct {
+	Topic       string    `json:"topic"`
+	Direction   string    `json:"direction"`
+	Reason      string    `json:"reason"`
+	Timestamp   time.Time `json:"timestamp"`
+	Payload     []byte    `json:"payload,omitempty"` // base64 encoded, left out when the payload was too large
+	PayloadSize int       `json:"payloadSize"`
+}
+
+// sendToDeadLetter publishes a message that could not be forwarded to {deadLetterTopic}/{topic} on ClearBlade,
+// messages are only logged if no dead letter topic is configured
+func sendToDeadLetter(direction, topic string, payload []byte, reason string) {
+	publishDeadLetter(deadLetter{Topic: topic, Direction: direction, Reason: reason, Payload: payload, PayloadSize: len(payload)})
+}
+
+// deadLetterMessage dead letters a message that couldn't be forwarded because of err. The payload of a message
+// over the payload limit is left out, as ClearBlade would reject the dead letter for being too large as well
+func deadLetterMessage(msg *bridgeMessage, err error) {
+	letter := deadLetter{Topic: msg.SourceTopic, Direction: msg.Direction, Reason: err.Error(), Payload: msg.Payload, PayloadSize: len(msg.Payload)}
+	if _, tooLarge := err.(*payloadTooLargeError); tooLarge {
+		letter.Payload = nil
+	}
+	publishDeadLetter(letter)
+}
+
+func publishDeadLetter(letter deadLetter) {
+	direction, topic, reason := letter.Direction, letter.Topic, letter.Reason
+	if dryRun {
+		recordDeadLetterDecision(direction, topic, reason)
+		return
+	}
+	if currentConfig().BrokerConfig.DeadLetterTopic == "" {
+		return
+	}
+
+	letter.Timestamp = time.Now().UTC()
+	envelope, err := json.Marshal(letter)
+	if err != nil {
+		log.Printf("[ERROR] publishDeadLetter - Failed to create dead letter for topic %s: %s\n", topic, err.Error())
+		return
+	}
+
+	topicToUse := strings.TrimSuffix(currentConfig().BrokerConfig.DeadLetterTopic, "/") + "/" + strings.TrimPrefix(topic, "/")
+	log.Printf("[DEBUG] publishDeadLetter - publishing %s message from topic %s to %s: %s\n", direction, topic, topicToUse, reason)
+
+	if cbMqttClient == nil || !cbMqttClient.IsConnected() {
+		log.Printf("[ERROR] publishDeadLetter - ClearBlade is not connected, dropping dead letter for topic %s\n", topic)
+		return
+	}
+	if token := cbMqttClient.Publish(topicToUse, qos(), false, envelope); token.Wait() && token.Error() != nil {
+		log.Printf("[ERROR] publishDeadLetter - Failed to publish dead letter for topic %s: %s\n", topic, token.Error())
+		return
+	}
+	incrementStat(statDeadLettered)
+}
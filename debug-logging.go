@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxSampledTopics limits how many topics the sampler tracks before it starts over
+const maxSampledTopics = 10000
+
+var messageSampler = topicSampler{topics: make(map[string]*topicSample)}
+
+// debugLoggingConfig controls how received messages are logged
+type debugLoggingConfig struct {
+	Enabled         bool     `json:"enabled"`         // log received messages even when logLevel is above debug
+	SampleEvery     int      `json:"sampleEvery"`     // only log every Nth message on each topic
+	MaxPerSecond    int      `json:"maxPerSecond"`    // log at most N messages per second on each topic
+	MaxPayloadBytes int      `json:"maxPayloadBytes"` // truncate logged payloads to this many bytes
+	RedactFields    []string `json:"redactFields"`    // JSON fields to redact, e.g. "password" or "user.email"
+}
+
+// topicSampler decides which received messages are logged, per topic
+type topicSampler struct {
+	sync.Mutex
+	topics map[string]*topicSample
+}
+
+type topicSample struct {
+	count       uint64
+	windowStart time.Time
+	windowCount int
+}
+
+func (s *topicSampler) sample(topic string, settings *debugLoggingConfig) bool {
+	if settings == nil || (settings.SampleEvery <= 1 && settings.MaxPerSecond <= 0) {
+		return true
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	state, ok := s.topics[topic]
+	if !ok {
+		if len(s.topics) >= maxSampledTopics {
+			s.topics = make(map[string]*topicSample)
+		}
+		state = &topicSample{}
+		s.topics[topic] = state
+	}
+
+	state.count++
+	if settings.SampleEvery > 1 && (state.count-1)%uint64(settings.SampleEvery) != 0 {
+		return false
+	}
+	if settings.MaxPerSecond > 0 {
+		now := time.Now()
+		if now.Sub(state.windowStart) >= time.Second {
+			state.windowStart = now
+			state.windowCount = 0
+		}
+		if state.windowCount >= settings.MaxPerSecond {
+			return false
+		}
+		state.windowCount++
+	}
+	return true
+}
+
+// logReceivedMessage logs the payload of a message received from either side, applying the sampling,
+// redaction and truncation in the debugLogging adapter settings
+func logReceivedMessage(component string, msg *bridgeMessage) {
+	settings := currentConfig().BrokerConfig.DebugLogging
+	force := settings != nil && settings.Enabled
+	if !force && !logFilter.Check([]byte("[DEBUG]")) {
+		return
+	}
+	if !messageSampler.sample(msg.SourceTopic, settings) {
+		return
+	}
+	writeMessageLog("DEBUG", component, msg, force, "message received: "+debugPayload(msg.Payload, settings))
+}
+
+// debugPayload returns the payload as it should appear in the logs
+func debugPayload(payload []byte, settings *debugLoggingConfig) string {
+	if settings == nil {
+		return string(payload)
+	}
+
+	if len(settings.RedactFields) > 0 {
+		var document interface{}
+		if err := json.Unmarshal(payload, &document); err != nil {
+			// there's no way to tell what needs redacting, so leave the payload out
+			return fmt.Sprintf("<%d bytes, not JSON>", len(payload))
+		}
+		document = redactFields(document, "", settings.RedactFields)
+		payload, _ = json.Marshal(document)
+	}
+
+	if settings.MaxPayloadBytes > 0 && len(payload) > settings.MaxPayloadBytes {
+		return fmt.Sprintf("%s... (%d bytes)", payload[:settings.MaxPayloadBytes], len(payload))
+	}
+	return string(payload)
+}
+
+// redactFields replaces the values of fields matching rules, a rule without dots matches the field at any depth
+// and a dotted rule matches the field at that path from the root of the document
+func redactFields(value interface{}, path string, rules []string) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			fieldPath := key
+			if path != "" {
+				fieldPath = path + "." + key
+			}
+			if redactedField(key, fieldPath, rules) {
+				v[key] = redacted
+			} else {
+				v[key] = redactFields(field, fieldPath, rules)
+			}
+		}
+	case []interface{}:
+		for i, element := range v {
+			v[i] = redactFields(element, path, rules)
+		}
+	}
+	return value
+}
+
+func redactedField(key, path string, rules []string) bool {
+	for _, rule := range rules {
+		if rule == path || (!strings.Contains(rule, ".") && rule == key) {
+			return true
+		}
+	}
+	return false
+}
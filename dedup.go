@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultDedupWindow     = 60 * time.Second
+	defaultDedupMaxEntries = 10000
+)
+
+var errDuplicateMessage = errors.New("duplicate of a message received within the dedup window")
+
+// dedupConfig drops incoming messages already received within the window, e.g. QoS 1 messages a device sends
+// again after reconnecting. Messages are the same if they have the same topic and payload, or the same topic and
+// id field when IDField is set
+type dedupConfig struct {
+	WindowSeconds int    `json:"windowSeconds"` // default 60
+	MaxEntries    int    `json:"maxEntries"`    // most messages remembered, the oldest are forgotten first, default 10000
+	IDField       string `json:"idField"`       // dotted path of a JSON field identifying the message, e.g. "meta.msgId"
+}
+
+// dedupWindow remembers the keys of the messages received within the window, oldest first
+type dedupWindow struct {
+	sync.Mutex
+	window     time.Duration
+	maxEntries int
+	seen       map[string]time.Time
+	order      []string
+}
+
+func newDedupWindow(settings *dedupConfig) *dedupWindow {
+	if settings == nil {
+		return nil
+	}
+	window := &dedupWindow{
+		window:     defaultDedupWindow,
+		maxEntries: defaultDedupMaxEntries,
+		seen:       make(map[string]time.Time),
+	}
+	if settings.WindowSeconds > 0 {
+		window.window = time.Duration(settings.WindowSeconds) * time.Second
+	}
+	if settings.MaxEntries > 0 {
+		window.maxEntries = settings.MaxEntries
+	}
+	return window
+}
+
+// add remembers key, returning false if it was already received within the window
+func (w *dedupWindow) add(key string) bool {
+	w.Lock()
+	defer w.Unlock()
+
+	now := time.Now()
+	for len(w.order) > 0 && (now.Sub(w.seen[w.order[0]]) >= w.window || len(w.order) >= w.maxEntries) {
+		delete(w.seen, w.order[0])
+		w.order = w.order[1:]
+	}
+	if _, ok := w.seen[key]; ok {
+		return false
+	}
+	w.seen[key] = now
+	w.order = append(w.order, key)
+	return true
+}
+
+// forget removes key, so the message isn't treated as a duplicate if it is sent again
+func (w *dedupWindow) forget(key string) {
+	w.Lock()
+	defer w.Unlock()
+	if _, ok := w.seen[key]; !ok {
+		return
+	}
+	delete(w.seen, key)
+	for i, existing := range w.order {
+		if existing == key {
+			w.order = append(w.order[:i], w.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// currentDedupWindow returns the dedup window of an identical route in the current config, so messages received
+// before the config was reloaded, e.g. when ClearBlade reconnects, are still dropped if they are sent again
+func currentDedupWindow(route routeConfig) *dedupWindow {
+	settings, err := json.Marshal(route)
+	if err != nil {
+		return nil
+	}
+	for _, existing := range currentConfig().BrokerConfig.Routes {
+		if existing.dedupWindow == nil {
+			continue
+		}
+		if existingSettings, err := json.Marshal(existing); err == nil && bytes.Equal(settings, existingSettings) {
+			return existing.dedupWindow
+		}
+	}
+	return nil
+}
+
+// dedupMessage returns errDuplicateMessage for incoming messages on routes with a dedup window that were already
+// received within the window
+func dedupMessage(msg *bridgeMessage) error {
+	if msg.Direction != directionIncoming {
+		return nil
+	}
+	route := findRoute(msg.Direction, msg.Topic)
+	if route == nil || route.dedupWindow == nil {
+		return nil
+	}
+
+	key := "payload:" + string(msg.Payload)
+	if route.Dedup.IDField != "" {
+		if id, ok := messageIDField(msg.Payload, route.Dedup.IDField); ok {
+			key = "id:" + id
+		}
+	}
+	hash := sha256.Sum256([]byte(msg.Topic + "\n" + key))
+	key = hex.EncodeToString(hash[:])
+
+	if !route.dedupWindow.add(key) {
+		return errDuplicateMessage
+	}
+	msg.dedupKey, msg.dedupWindow = key, route.dedupWindow
+	return nil
+}
+
+// forgetMessage removes a message that couldn't be forwarded from its dedup window, so a retry isn't dropped
+func forgetMessage(msg *bridgeMessage) {
+	if msg.dedupWindow != nil {
+		msg.dedupWindow.forget(msg.dedupKey)
+	}
+}
+
+// messageIDField returns the value of the field at a dotted path in a JSON object payload
+func messageIDField(payload []byte, path string) (string, bool) {
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber() // large integer ids would collide as floats
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return "", false
+	}
+	for _, key := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		if value, ok = object[key]; !ok || value == nil {
+			return "", false
+		}
+	}
+	if id, ok := value.(string); ok {
+		return id, true
+	}
+	id, err := json.Marshal(value)
+	if err != nil {
+		return "", false
+	}
+	return string(id), true
+}
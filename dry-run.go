@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+const (
+	verdictForward    = "forward"
+	verdictPaused     = "paused"
+	verdictDenied     = "denied"
+	verdictDeadLetter = "dead-letter"
+	verdictDropped    = "dropped"
+	verdictDuplicate  = "duplicate"
+)
+
+var (
+	dryRun          bool
+	dryRunDecisions = routingSummary{counts: make(map[routingDecision]uint64)}
+)
+
+// routingDecision is what the bridge would have done with a message in dry run mode
+type routingDecision struct {
+	Direction   string
+	Destination string
+	Verdict     string
+}
+
+// routingSummary counts the routing decisions made since the adapter started
+type routingSummary struct {
+	sync.Mutex
+	counts map[routingDecision]uint64
+}
+
+// recordRoutingDecision logs what would have happened to a message instead of publishing it, it does
+// nothing unless the adapter is running with -dryRun
+func recordRoutingDecision(msg *bridgeMessage, destination, verdict string) {
+	if !dryRun {
+		return
+	}
+	logMessage("INFO", "dryRun", msg, "-> %s verdict: %s transforms: [%s]", destination, verdict, strings.Join(msg.Transforms, ", "))
+	addRoutingDecision(routingDecision{Direction: msg.Direction, Destination: destination, Verdict: verdict})
+}
+
+// recordDeadLetterDecision logs a message that would have been dead lettered, or dropped if no dead letter
+// topic is configured
+func recordDeadLetterDecision(direction, topic, reason string) {
+	decision := routingDecision{Direction: direction, Verdict: verdictDropped}
+	if deadLetterTopic := currentConfig().BrokerConfig.DeadLetterTopic; deadLetterTopic != "" {
+		decision.Destination = strings.TrimSuffix(deadLetterTopic, "/") + "/" + strings.TrimPrefix(topic, "/")
+		decision.Verdict = verdictDeadLetter
+	}
+	log.Printf("[INFO] dryRun - %s %s -> %s verdict: %s reason: %s\n", direction, topic, decision.Destination, decision.Verdict, reason)
+	// the summary groups dead letters by dead letter topic rather than by message topic
+	decision.Destination = currentConfig().BrokerConfig.DeadLetterTopic
+	addRoutingDecision(decision)
+}
+
+func addRoutingDecision(decision routingDecision) {
+	dryRunDecisions.Lock()
+	dryRunDecisions.counts[decision]++
+	dryRunDecisions.Unlock()
+}
+
+// logRoutingSummary logs how many messages went to each destination since the adapter started
+func logRoutingSummary() {
+	dryRunDecisions.Lock()
+	lines := make([]string, 0, len(dryRunDecisions.counts))
+	for decision, count := range dryRunDecisions.counts {
+		destination := decision.Destination
+		if destination == "" {
+			destination = "-"
+		}
+		lines = append(lines, fmt.Sprintf("  %s -> %s (%s): %d", decision.Direction, destination, decision.Verdict, count))
+	}
+	dryRunDecisions.Unlock()
+
+	sort.Strings(lines)
+	log.Printf("[INFO] logRoutingSummary - Dry run routing summary:\n%s\n", strings.Join(lines, "\n"))
+}
+
+// dryRunSummaryOnExit logs the routing summary when the adapter is stopped
+func dryRunSummaryOnExit() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	<-signals
+	logRoutingSummary()
+	os.Exit(0)
+}
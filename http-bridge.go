@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	signatureHeader    = "X-Bridge-Signature" // sha256=<hex encoded HMAC of the timestamp, topic and request body>
+	timestampHeader    = "X-Bridge-Timestamp" // unix time the request was signed at
+	topicHeader        = "X-Bridge-Topic"
+	compressionHeader  = "X-Bridge-Compression" // set to the algorithm when a route compresses with the suffix marker
+	ingestPathPrefix   = "/publish/"
+	maxIngestBodyBytes = 10 << 20
+	maxSignatureAge    = 5 * time.Minute // signed ingest requests older than this are rejected, so they can't be replayed
+)
+
+var (
+	httpClient = &http.Client{} // sendWebhook sets the timeout per request, so the client exists before initHTTP runs
+	httpServer *http.Server
+)
+
+type httpConfig struct {
+	ListenAddress  string         `json:"listenAddress"`
+	Secret         string         `json:"secret"`
+	MaxRetries     int            `json:"maxRetries"`
+	TimeoutSeconds int            `json:"timeoutSeconds"`
+	Webhooks       []webhookRoute `json:"webhooks"`
+}
+
+// webhookRoute POSTs messages whose topic (relative to {topic_root}/outgoing) matches Topic to URL,
+// URL is a text/template with access to the topic, e.g. https://example.com/devices/{{.Level 2}}/events
+type webhookRoute struct {
+	Topic   string            `json:"topic"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+}
+
+// webhookTemplateData holds the topic with each level escaped, so a level can't change the URL's path or query
+type webhookTemplateData struct {
+	Topic  string
+	Levels []string
+}
+
+func newWebhookTemplateData(topic string) webhookTemplateData {
+	levels := strings.Split(topic, "/")
+	for i, level := range levels {
+		levels[i] = escapeURLLevel(level)
+	}
+	return webhookTemplateData{Topic: strings.Join(levels, "/"), Levels: levels}
+}
+
+// Level returns the 1 based level of the topic
+func (d webhookTemplateData) Level(level int) string {
+	if level < 1 || level > len(d.Levels) {
+		return ""
+	}
+	return d.Levels[level-1]
+}
+
+// escapeURLLevel escapes a topic level for use as one segment of a URL path, including the . and .. segments
+// that PathEscape leaves alone
+func escapeURLLevel(level string) string {
+	if level == "." || level == ".." {
+		return strings.Repeat("%2E", len(level))
+	}
+	return url.PathEscape(level)
+}
+
+func initHTTP() error {
+	log.Println("[INFO] initHTTP - Initializing HTTP bridge")
+
+	httpConf := currentConfig().BrokerConfig.HTTP
+	setConnected(connectionExternal, true)
+
+	if httpConf.ListenAddress == "" || httpServer != nil {
+		return nil
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(ingestPathPrefix, ingestHandler)
+	httpServer = &http.Server{Addr: httpConf.ListenAddress, Handler: mux}
+
+	go func() {
+		log.Printf("[INFO] initHTTP - Listening for messages on %s%s\n", httpConf.ListenAddress, ingestPathPrefix)
+		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("[FATAL] initHTTP - HTTP server failed: %s", err.Error())
+		}
+	}()
+	return nil
+}
+
+// ingestHandler forwards the body of a POST to /publish/{topic...} to {topic_root}/incoming/{topic...}
+func ingestHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	topic := strings.Trim(strings.TrimPrefix(r.URL.Path, ingestPathPrefix), "/")
+	if topic == "" {
+		http.Error(w, "missing topic", http.StatusBadRequest)
+		return
+	}
+	// the path is already unescaped, so %2B and %23 arrive as wildcards
+	if err := checkIngestTopic(topic); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	payload, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxIngestBodyBytes))
+	if err != nil {
+		http.Error(w, "unable to read body", http.StatusBadRequest)
+		return
+	}
+
+	if secret := currentConfig().BrokerConfig.HTTP.Secret; secret != "" {
+		if err := verifySignature(secret, r.Header, topic, payload); err != nil {
+			log.Printf("[ERROR] ingestHandler - Rejecting message on topic %s: %s\n", topic, err.Error())
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+	}
+
+	msg := &bridgeMessage{ID: newCorrelationID(), Direction: directionIncoming, SourceTopic: r.URL.Path, Topic: topic, Payload: payload, Compression: r.Header.Get(compressionHeader)}
+	logReceivedMessage("ingestHandler", msg)
+	recordMessage(msg)
+
+	span := startReceiveSpan(msg)
+	err = forwardIncoming(msg)
+	endSpan(span, err)
+	if err == errForwardingPaused {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	} else if isPublishError(err) {
+		// the sender can try again once ClearBlade is reachable
+		logMessage("ERROR", "ingestHandler", msg, "failed to forward message to ClearBlade: %s", err.Error())
+		http.Error(w, "failed to forward message", http.StatusBadGateway)
+		return
+	} else if err != nil {
+		// the message would be rejected again, so dead letter it and tell the sender not to retry
+		logMessage("ERROR", "ingestHandler", msg, "unable to forward message to ClearBlade: %s", err.Error())
+		deadLetterMessage(msg, err)
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// postWebhook POSTs a message from {topic_root}/outgoing/{topic} to the URL of the first matching webhook,
+// retrying with a backoff on network errors, 429 and 5xx responses
+func postWebhook(topic, compression string, payload []byte) error {
+	httpConf := currentConfig().BrokerConfig.HTTP
+
+	route := findWebhookRoute(topic)
+	if route == nil {
+		return fmt.Errorf("no webhook defined for topic %s", topic)
+	}
+
+	url, err := webhookURL(route.URL, topic)
+	if err != nil {
+		return err
+	}
+
+	maxRetries := httpConf.MaxRetries
+	if maxRetries <= 0 {
+		maxRetries = 3
+	}
+
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		retry, err := sendWebhook(url, route.Headers, topic, compression, payload)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt >= maxRetries {
+			return err
+		}
+		log.Printf("[ERROR] postWebhook - %s, trying again in %s\n", err.Error(), backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func findWebhookRoute(topic string) *webhookRoute {
+	webhooks := currentConfig().BrokerConfig.HTTP.Webhooks
+	for i := range webhooks {
+		if topicMatchesFilter(webhooks[i].Topic, topic) {
+			return &webhooks[i]
+		}
+	}
+	return nil
+}
+
+// sendWebhook makes a single POST, returning whether a failed request should be retried
+func sendWebhook(url string, headers map[string]string, topic, compression string, payload []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return false, err
+	}
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	req.Header.Set(topicHeader, topic)
+	if compression != "" {
+		req.Header.Set(compressionHeader, compression)
+	}
+	if secret := currentConfig().BrokerConfig.HTTP.Secret; secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(timestampHeader, timestamp)
+		req.Header.Set(signatureHeader, signPayload(secret, timestamp, topic, payload))
+	}
+
+	timeout := currentConfig().BrokerConfig.HTTP.TimeoutSeconds
+	if timeout <= 0 {
+		timeout = 10
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	resp, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return true, fmt.Errorf("failed to POST to %s: %s", url, err.Error())
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retry, fmt.Errorf("POST to %s returned status %d", url, resp.StatusCode)
+}
+
+func webhookURL(urlTemplate, topic string) (string, error) {
+	tmpl, err := template.New("url").Parse(urlTemplate)
+	if err != nil {
+		return "", fmt.Errorf("invalid webhook url template %s: %s", urlTemplate, err.Error())
+	}
+	var url bytes.Buffer
+	if err := tmpl.Execute(&url, newWebhookTemplateData(topic)); err != nil {
+		return "", fmt.Errorf("failed to build webhook url for topic %s: %s", topic, err.Error())
+	}
+	return url.String(), nil
+}
+
+// signPayload signs the topic along with the payload, so a signed request can't be sent again to another topic
+func signPayload(secret, timestamp, topic string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "\n" + topic + "\n"))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifySignature checks the signature of an ingest request and that it was signed within maxSignatureAge
+func verifySignature(secret string, header http.Header, topic string, payload []byte) error {
+	timestamp := header.Get(timestampHeader)
+	signedAt, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("missing or invalid %s header", timestampHeader)
+	}
+	if age := time.Since(time.Unix(signedAt, 0)); age > maxSignatureAge || age < -maxSignatureAge {
+		return fmt.Errorf("request was signed more than %s ago", maxSignatureAge)
+	}
+	expected := signPayload(secret, timestamp, topic, payload)
+	if !hmac.Equal([]byte(header.Get(signatureHeader)), []byte(expected)) {
+		return fmt.Errorf("invalid signature")
+	}
+	return nil
+}
+
+// checkIngestTopic returns an error if a topic POSTed to the ingest server can't be published to ClearBlade
+func checkIngestTopic(topic string) error {
+	if err := checkTopicName(topic); err != nil {
+		return err
+	}
+	for _, level := range strings.Split(topic, "/") {
+		if level == "" {
+			return fmt.Errorf("%s: topic must not contain empty levels", topic)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	kafkaTopicHeader       = "mqtt_topic"  // header used to carry the original MQTT topic through Kafka
+	kafkaCompressionHeader = "compression" // set to the algorithm when a route compresses with the suffix marker
+)
+
+var (
+	kafkaWriter      *kafka.Writer
+	kafkaWriterMutex sync.RWMutex // kafkaWriter is replaced by initKafka while messages are being produced
+	kafkaCancelCtx   context.CancelFunc
+)
+
+type kafkaConfig struct {
+	Brokers  []string     `json:"brokers"`
+	GroupID  string       `json:"groupID"`
+	Outgoing []kafkaRoute `json:"outgoing"`
+	Incoming []kafkaRoute `json:"incoming"`
+}
+
+// kafkaRoute maps MQTT topics to a Kafka topic. Topic is relative to {topic_root}/outgoing
+// for outgoing routes and {topic_root}/incoming for incoming routes, and may contain wildcards
+type kafkaRoute struct {
+	Topic      string `json:"topic"`
+	KafkaTopic string `json:"kafkaTopic"`
+	KeyLevel   int    `json:"keyLevel"` // 1 based MQTT topic level used as the Kafka message key, 0 to send without a key
+}
+
+func initKafka() error {
+	log.Println("[INFO] initKafka - Initializing Kafka")
+
+	kafkaConf := currentConfig().BrokerConfig.Kafka
+
+	// make sure at least one broker is reachable before we start producing and consuming
+	var conn *kafka.Conn
+	var err error
+	for _, broker := range kafkaConf.Brokers {
+		if conn, err = kafka.Dial("tcp", broker); err == nil {
+			break
+		}
+		log.Printf("[ERROR] initKafka - Unable to connect to Kafka broker %s: %s\n", broker, err.Error())
+	}
+	if err != nil {
+		return err
+	}
+	conn.Close()
+
+	if kafkaCancelCtx != nil {
+		kafkaCancelCtx()
+	}
+
+	kafkaWriterMutex.Lock()
+	if kafkaWriter != nil {
+		kafkaWriter.Close()
+	}
+	// the hash balancer keeps messages with the same key on the same partition so per key ordering is kept
+	kafkaWriter = &kafka.Writer{
+		Addr:         kafka.TCP(kafkaConf.Brokers...),
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: kafka.RequireAll,
+		BatchTimeout: 10 * time.Millisecond,
+	}
+	kafkaWriterMutex.Unlock()
+
+	groupID := kafkaConf.GroupID
+	if groupID == "" {
+		groupID = deviceName
+	}
+
+	var ctx context.Context
+	ctx, kafkaCancelCtx = context.WithCancel(context.Background())
+
+	for _, route := range kafkaConf.Incoming {
+		log.Printf("[INFO] initKafka - Consuming Kafka topic %s with group %s\n", route.KafkaTopic, groupID)
+		reader := kafka.NewReader(kafka.ReaderConfig{
+			Brokers: kafkaConf.Brokers,
+			GroupID: groupID,
+			Topic:   route.KafkaTopic,
+		})
+		go kafkaConsumer(ctx, reader, route)
+	}
+
+	log.Println("[INFO] initKafka - Kafka Connected")
+	setConnected(connectionExternal, true)
+	return nil
+}
+
+// kafkaConsumer forwards messages from a Kafka topic to ClearBlade, offsets are only committed once
+// the message has been published to ClearBlade or dead lettered
+func kafkaConsumer(ctx context.Context, reader *kafka.Reader, route kafkaRoute) {
+	defer reader.Close()
+	for {
+		message, err := reader.FetchMessage(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				log.Println("[DEBUG] kafkaConsumer - Cancelling context..")
+				return
+			}
+			log.Printf("[ERROR] kafkaConsumer - Failed to fetch message from Kafka topic %s: %s\n", route.KafkaTopic, err.Error())
+			time.Sleep(time.Duration(time.Second * 1))
+			continue
+		}
+
+		topic, err := kafkaMessageTopic(message, route)
+		if err != nil {
+			log.Printf("[ERROR] kafkaConsumer - Unable to forward message from Kafka topic %s: %s\n", route.KafkaTopic, err.Error())
+			sendToDeadLetter(directionIncoming, message.Topic, message.Value, err.Error())
+			if !dryRun {
+				if err := reader.CommitMessages(ctx, message); err != nil {
+					log.Printf("[ERROR] kafkaConsumer - Failed to commit offset for Kafka topic %s: %s\n", route.KafkaTopic, err.Error())
+				}
+			}
+			continue
+		}
+		msg := &bridgeMessage{ID: newCorrelationID(), Direction: directionIncoming, SourceTopic: message.Topic, Topic: topic, Payload: message.Value}
+		for _, header := range message.Headers {
+			if header.Key == kafkaCompressionHeader {
+				msg.Compression = string(header.Value)
+			}
+		}
+		logReceivedMessage("kafkaConsumer", msg)
+		recordMessage(msg)
+
+		// only retry while paused or ClearBlade can't be published to, anything else would fail again and
+		// hold up the rest of the partition
+		span := startReceiveSpan(msg)
+		for err = forwardIncoming(msg); err == errForwardingPaused || isPublishError(err); err = forwardIncoming(msg) {
+			if err != errForwardingPaused {
+				logMessage("ERROR", "kafkaConsumer", msg, "failed to forward message to ClearBlade, trying again in 1 second: %s", err.Error())
+			}
+			select {
+			case <-ctx.Done():
+				endSpan(span, ctx.Err())
+				return
+			case <-time.After(time.Second * 1):
+			}
+		}
+		if err != nil {
+			logMessage("ERROR", "kafkaConsumer", msg, "unable to forward message to ClearBlade: %s", err.Error())
+			deadLetterMessage(msg, err)
+		}
+		endSpan(span, err)
+
+		if dryRun {
+			// leave the offset uncommitted so the message is still delivered once dry run mode is turned off
+			continue
+		}
+
+		if err := reader.CommitMessages(ctx, message); err != nil {
+			log.Printf("[ERROR] kafkaConsumer - Failed to commit offset for Kafka topic %s: %s\n", route.KafkaTopic, err.Error())
+		}
+	}
+}
+
+// produceKafka writes a message from {topic_root}/outgoing/{topic} to the Kafka topic of the first matching outgoing route
+func produceKafka(topic, compression string, payload []byte) error {
+	route := findKafkaRoute(currentConfig().BrokerConfig.Kafka.Outgoing, topic)
+	if route == nil {
+		return fmt.Errorf("no Kafka route defined for topic %s", topic)
+	}
+
+	message := kafka.Message{
+		Topic:   route.KafkaTopic,
+		Value:   payload,
+		Headers: []kafka.Header{{Key: kafkaTopicHeader, Value: []byte(topic)}},
+	}
+	if compression != "" {
+		message.Headers = append(message.Headers, kafka.Header{Key: kafkaCompressionHeader, Value: []byte(compression)})
+	}
+	if route.KeyLevel > 0 {
+		message.Key = []byte(topicLevel(topic, route.KeyLevel))
+	}
+
+	// outgoing messages can arrive from ClearBlade before initKafka has connected
+	kafkaWriterMutex.RLock()
+	writer := kafkaWriter
+	kafkaWriterMutex.RUnlock()
+	if writer == nil {
+		return fmt.Errorf("Kafka is not yet connected")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return writer.WriteMessages(ctx, message)
+}
+
+func findKafkaRoute(routes []kafkaRoute, topic string) *kafkaRoute {
+	for i := range routes {
+		if topicMatchesFilter(routes[i].Topic, topic) {
+			return &routes[i]
+		}
+	}
+	return nil
+}
+
+// kafkaMessageTopic works out the MQTT topic for a consumed message, preferring the topic header written by
+// produceKafka, then the route topic when it has no wildcards, and finally the Kafka topic name. The header is
+// set by whoever produced the message, so it is rejected if it isn't a topic that can be published to
+func kafkaMessageTopic(message kafka.Message, route kafkaRoute) (string, error) {
+	for _, header := range message.Headers {
+		if header.Key == kafkaTopicHeader && len(header.Value) > 0 {
+			if err := checkTopicName(string(header.Value)); err != nil {
+				return "", fmt.Errorf("invalid %s header: %s", kafkaTopicHeader, err.Error())
+			}
+			return string(header.Value), nil
+		}
+	}
+	if route.Topic != "" && !strings.ContainsAny(route.Topic, "+#") {
+		return route.Topic, nil
+	}
+	return message.Topic, nil
+}
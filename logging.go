@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hashicorp/logutils"
+)
+
+const (
+	logFormatText   = "text"
+	logFormatJSON   = "json"
+	logFormatLogfmt = "logfmt"
+)
+
+var (
+	logFormat string
+	logFilter *logutils.LevelFilter
+	logLevels = []logutils.LogLevel{"DEBUG", "INFO", "WARN", "ERROR", "FATAL"}
+	logWriter *structuredWriter // nil when logging as text
+
+	unfilteredLog *log.Logger
+)
+
+// logFields are extra fields added to a structured log entry
+type logFields map[string]interface{}
+
+// initLogging sends the standard logger through a level filter, and through a structured writer for
+// the json and logfmt formats
+func initLogging() {
+	logFilter = &logutils.LevelFilter{
+		Levels:   logLevels,
+		MinLevel: logutils.LogLevel(strings.ToUpper(logLevel)),
+		Writer:   os.Stdout,
+	}
+
+	switch logFormat {
+	case logFormatJSON, logFormatLogfmt:
+		// the structured writer adds its own timestamp
+		log.SetFlags(0)
+		logWriter = &structuredWriter{format: logFormat, out: os.Stdout}
+		logFilter.Writer = logWriter
+	default:
+		log.SetFlags(log.LstdFlags | log.Lshortfile)
+	}
+	log.SetOutput(logFilter)
+	unfilteredLog = log.New(logFilter.Writer, "", log.Flags())
+
+	go logLevelSignalHandler()
+}
+
+func validLogLevel(level string) bool {
+	for _, l := range logLevels {
+		if string(l) == strings.ToUpper(level) {
+			return true
+		}
+	}
+	return false
+}
+
+// setLogLevel changes the minimum level that is logged while the adapter is running
+func setLogLevel(level string) error {
+	if !validLogLevel(level) {
+		return fmt.Errorf("unknown log level: %s", level)
+	}
+	logFilter.SetMinLevel(logutils.LogLevel(strings.ToUpper(level)))
+	log.Printf("[INFO] setLogLevel - Log level set to %s\n", strings.ToUpper(level))
+	return nil
+}
+
+// logLevelSignalHandler toggles between debug logging and the -logLevel level on SIGUSR1
+func logLevelSignalHandler() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	debug := false
+	for range signals {
+		debug = !debug
+		level := logLevel
+		if debug {
+			level = "debug"
+		}
+		if err := setLogLevel(level); err != nil {
+			log.Printf("[ERROR] logLevelSignalHandler - %s\n", err.Error())
+		}
+	}
+}
+
+func newCorrelationID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// logMessage logs an event about a bridged message, adding the message's correlation id, direction,
+// topic and payload size as fields
+func logMessage(level, component string, msg *bridgeMessage, format string, args ...interface{}) {
+	writeMessageLog(level, component, msg, false, fmt.Sprintf(format, args...))
+}
+
+// writeMessageLog writes a log entry about a bridged message, when force is set the entry is written even if
+// its level is below the current log level
+func writeMessageLog(level, component string, msg *bridgeMessage, force bool, text string) {
+	if !force && !logFilter.Check([]byte("["+level+"]")) {
+		return
+	}
+	fields := logFields{
+		"correlation_id": msg.ID,
+		"direction":      msg.Direction,
+		"topic":          msg.SourceTopic,
+		"payload_size":   len(msg.Payload),
+	}
+
+	if logWriter != nil {
+		logWriter.writeEntry(level, component, text, fields)
+		return
+	}
+	// skip the level filter, it has already been checked
+	unfilteredLog.Output(3, fmt.Sprintf("[%s] %s - %s %s\n", level, component, strings.TrimRight(text, "\n"), formatLogfmt(fields)))
+}
+
+// structuredWriter turns lines written by the standard logger, "[LEVEL] component - message", into
+// json or logfmt entries
+type structuredWriter struct {
+	sync.Mutex
+	format string
+	out    io.Writer
+}
+
+func (w *structuredWriter) Write(p []byte) (int, error) {
+	level, component, msg := parseLogLine(string(p))
+	w.writeEntry(level, component, msg, nil)
+	return len(p), nil
+}
+
+func (w *structuredWriter) writeEntry(level, component, msg string, fields logFields) {
+	entry := logFields{}
+	for key, value := range fields {
+		entry[key] = value
+	}
+	entry["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	entry["level"] = strings.ToLower(level)
+	entry["msg"] = strings.TrimRight(msg, "\n")
+	if component != "" {
+		entry["component"] = component
+	}
+
+	var line []byte
+	if w.format == logFormatJSON {
+		var err error
+		if line, err = json.Marshal(entry); err != nil {
+			line = []byte(fmt.Sprintf(`{"level":"error","msg":%q}`, "unable to encode log entry: "+err.Error()))
+		}
+	} else {
+		line = []byte(formatLogfmt(entry))
+	}
+
+	w.Lock()
+	defer w.Unlock()
+	w.out.Write(append(line, '\n'))
+}
+
+// parseLogLine splits a line from the standard logger into its level, the function that logged it and the message
+func parseLogLine(line string) (string, string, string) {
+	level := "INFO"
+	if strings.HasPrefix(line, "[") {
+		if end := strings.Index(line, "]"); end > 0 {
+			level = line[1:end]
+			line = strings.TrimLeft(line[end+1:], " ")
+		}
+	}
+	if sep := strings.Index(line, " - "); sep > 0 && !strings.ContainsAny(line[:sep], " \n") {
+		return level, line[:sep], line[sep+3:]
+	}
+	return level, "", line
+}
+
+// formatLogfmt formats fields as key=value pairs, starting with time, level, component and msg
+func formatLogfmt(fields logFields) string {
+	var keys, others []string
+	for _, key := range []string{"time", "level", "component", "msg"} {
+		if _, ok := fields[key]; ok {
+			keys = append(keys, key)
+		}
+	}
+	for key := range fields {
+		switch key {
+		case "time", "level", "component", "msg":
+		default:
+			others = append(others, key)
+		}
+	}
+	sort.Strings(others)
+	keys = append(keys, others...)
+
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		value := fmt.Sprint(fields[key])
+		if value == "" || strings.ContainsAny(value, " =\"\n\t") {
+			value = strconv.Quote(value)
+		}
+		pairs = append(pairs, key+"="+value)
+	}
+	return strings.Join(pairs, " ")
+}
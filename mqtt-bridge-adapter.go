@@ -1,22 +1,24 @@
 package main
 
 import (
+	"bytes"
 	"context"
-	"encoding/json"
+	crand "crypto/rand"
+	"encoding/hex"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"math/rand"
 	"os"
-	"strconv"
+	"path/filepath"
 	"strings"
 	"sync"
 	"time"
 
 	cb "github.com/clearblade/Go-SDK"
-	mqttTypes "github.com/clearblade/mqtt_parsing"
 	mqtt "github.com/clearblade/paho.mqtt.golang"
-	"github.com/hashicorp/logutils"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var (
@@ -26,39 +28,95 @@ var (
 	sysSec              string
 	deviceName          string //Defaults to mqttBridgeAdapter
 	activeKey           string
+	authType            string //Defaults to device
+	email               string
+	token               string
 	logLevel            string //Defaults to info
 	adapterConfigCollID string
-	config              adapterConfig
-	cbClient            *cb.DeviceClient
+	cbClientID          string
+	persistentSession   bool
+	storeDirectory      string
+	config              adapterConfig // read with currentConfig, it is replaced on reconnects and reloads
+	configMutex         sync.RWMutex
+	cbClient            cb.Client
 	cbMqttClient        mqtt.Client
+	cbSubChannel        chan mqtt.Message
 	cbSentMessages      SentMessages
-	cbCancelCtx         context.CancelFunc
-	otherCancelCtx      context.CancelFunc
-	cbCtx               context.Context
-	otherCtx            context.Context
+	instanceID          string
+	instanceIDOnce      sync.Once
 )
 
 const (
-	qos = 0 // qos to use for all sub/pubs
+	modeMQTT  = "mqtt"  // bridge to an external MQTT broker
+	modeKafka = "kafka" // bridge to a Kafka cluster
+	modeHTTP  = "http"  // bridge to HTTP webhooks and accept messages over HTTP
+
+	instanceIDFile = "instance-id" // in storeDirectory
 )
 
 type adapterConfig struct {
 	BrokerConfig mqttBroker `json:"adapter_settings"`
 	TopicRoot    string     `json:"topic_root"`
+	Version      string     `json:"-"`
 }
 
 type mqttBroker struct {
-	MessagingURL string   `json:"messagingURL"`
-	Username     string   `json:"username"`
-	Password     string   `json:"password"`
-	Topics       []string `json:"topics"`
-	PlatformURL  string   `json:"platformURL"`
-	SystemKey    string   `json:"systemKey"`
-	SystemSecret string   `json:"systemSecret"`
-	DeviceName   string   `json:"deviceName"`
-	ActiveKey    string   `json:"activeKey"`
-	IsCbBroker   bool     `json:"isCbBroker"`
-	Client       mqtt.Client
+	Mode                  string                `json:"mode"`
+	Kafka                 *kafkaConfig          `json:"kafka"`
+	HTTP                  *httpConfig           `json:"http"`
+	MessagingURL          string                `json:"messagingURL"`
+	Username              string                `json:"username"`
+	Password              string                `json:"password"`
+	Topics                []string              `json:"topics"`
+	QoS                   int                   `json:"qos"`
+	ClientID              string                `json:"clientID"`
+	PersistentSession     bool                  `json:"persistentSession"`
+	PlatformURL           string                `json:"platformURL"`
+	SystemKey             string                `json:"systemKey"`
+	SystemSecret          string                `json:"systemSecret"`
+	DeviceName            string                `json:"deviceName"`
+	ActiveKey             string                `json:"activeKey"`
+	IsCbBroker            bool                  `json:"isCbBroker"`
+	AuthType              string                `json:"authType"`
+	Email                 string                `json:"email"`
+	Token                 string                `json:"token"`
+	RemoteTopicRoot       string                `json:"remoteTopicRoot"`
+	DeadLetterTopic       string                `json:"deadLetterTopic"`
+	StatusIntervalSeconds int                   `json:"statusIntervalSeconds"`
+	DebugLogging          *debugLoggingConfig   `json:"debugLogging"`
+	WorkerPool            *workerPoolConfig     `json:"workerPool"`
+	OutgoingFilter        *outgoingFilterConfig `json:"outgoingFilter"`
+	PayloadLimits         *payloadLimitsConfig  `json:"payloadLimits"`
+	Routes                []routeConfig         `json:"routes"`
+	Telemetry             *telemetryConfig      `json:"telemetry"`
+	Client                mqtt.Client
+}
+
+// bridgeMessage is a message being forwarded across the bridge
+type bridgeMessage struct {
+	ID          string // correlation id used to follow the message through the logs
+	Direction   string // directionOutgoing or directionIncoming
+	SourceTopic string // topic the message was received on
+	Topic       string // topic relative to {topic_root}/outgoing or {topic_root}/incoming
+	Payload     []byte
+	Qos         byte
+	Retained    bool
+	Transforms  []string        // names of the transforms applied to the message, in order
+	Context     context.Context // trace context of the message's receive span
+	Chunks      [][]byte        // set when the payload has been split to fit the payload limit
+	Compression string          // compression marked by a topic suffix, or a header in Kafka and HTTP mode
+
+	// set when the message has been added to a dedup window
+	dedupKey    string
+	dedupWindow *dedupWindow
+}
+
+// payloads returns the payloads to publish for the message, either its chunks or the whole payload
+func (m *bridgeMessage) payloads() [][]byte {
+	if len(m.Chunks) > 0 {
+		return m.Chunks
+	}
+	return [][]byte{m.Payload}
 }
 
 type SentKey struct {
@@ -75,10 +133,25 @@ func init() {
 	flag.StringVar(&sysSec, "systemSecret", "", "system secret (required)")
 	flag.StringVar(&deviceName, "deviceName", "mqttBridgeAdapter", "name of device (optional)")
 	flag.StringVar(&activeKey, "password", "", "password (or active key) for device authentication (required)")
+	flag.StringVar(&authType, "authType", authTypeDevice, "How to authenticate with ClearBlade. Available types are 'device', 'user', 'developer', 'token' (optional)")
+	flag.StringVar(&email, "email", "", "email for user or developer authentication (required for user and developer authType)")
+	flag.StringVar(&token, "token", "", "pre-issued token (required for token authType)")
 	flag.StringVar(&platformURL, "platformURL", "http://localhost:9000", "platform url (optional)")
 	flag.StringVar(&messagingURL, "messagingURL", "localhost:1883", "messaging URL (optional)")
 	flag.StringVar(&logLevel, "logLevel", "info", "The level of logging to use. Available levels are 'debug, 'info', 'warn', 'error', 'fatal' (optional)")
+	flag.StringVar(&logFormat, "logFormat", logFormatText, "The format of log output. Available formats are 'text', 'json', 'logfmt' (optional)")
 	flag.StringVar(&adapterConfigCollID, "adapterConfigCollectionID", "", "The ID of the data collection used to house adapter configuration (required)")
+	flag.StringVar(&cbClientID, "clientID", "", "MQTT client ID used to connect to ClearBlade, defaults to <deviceName>-<instance id> (optional)")
+	flag.BoolVar(&persistentSession, "persistentSession", false, "Use a persistent MQTT session for the ClearBlade connection (optional)")
+	flag.DurationVar(&tokenRefreshInterval, "tokenRefreshInterval", 12*time.Hour, "How often to re-authenticate with ClearBlade before tokens expire, 0 to disable (optional)")
+	flag.StringVar(&secretKeyFile, "secretKeyFile", "", "File containing the base64 encoded AES key used to decrypt enc: secrets (optional)")
+	flag.StringVar(&storeDirectory, "storeDirectory", "/var/lib/mqttBridgeAdapter", "Directory used to store in flight messages for persistent MQTT sessions (optional)")
+	flag.StringVar(&recordFile, "recordFile", "", "File to record every bridged message to as newline delimited JSON, recording is disabled if empty (optional)")
+	flag.IntVar(&recordMaxSizeMB, "recordMaxSizeMB", 100, "Size in MB at which the recording file is rotated (optional)")
+	flag.IntVar(&recordMaxFiles, "recordMaxFiles", 5, "Number of rotated recording files to keep (optional)")
+	flag.StringVar(&otlpEndpoint, "otlpEndpoint", "", "host:port of an OTLP/HTTP collector to export traces to, tracing is disabled if empty (optional)")
+	flag.StringVar(&traceContextField, "traceContextField", "traceparent", "JSON payload field used to carry W3C trace context across the bridge (optional)")
+	flag.BoolVar(&dryRun, "dryRun", false, "Connect and subscribe as normal, but log where each message would be sent instead of publishing it (optional)")
 }
 
 func usage() {
@@ -89,16 +162,53 @@ func usage() {
 func validateFlags() {
 	flag.Parse()
 
-	if sysKey == "" || sysSec == "" || activeKey == "" || adapterConfigCollID == "" {
+	switch logFormat {
+	case logFormatText, logFormatJSON, logFormatLogfmt:
+	default:
+		log.Printf("ERROR - Unknown logFormat: %s\n", logFormat)
+		flag.Usage()
+		os.Exit(1)
+	}
+	if !validLogLevel(logLevel) {
+		log.Printf("ERROR - Unknown logLevel: %s\n", logLevel)
+		flag.Usage()
+		os.Exit(1)
+	}
+	checkRequiredFlags()
+}
+
+// checkRequiredFlags exits if any required flags are missing, and resolves secret flags
+func checkRequiredFlags() {
+	if adapterConfigCollID == "" {
 		log.Println("ERROR - Missing required flags")
 		flag.Usage()
 		os.Exit(1)
 	}
+
+	// secret flags support the same env:, file: and enc: references as adapter_settings
+	for _, secret := range []*string{&sysSec, &activeKey, &token} {
+		resolved, err := resolveSecret(*secret)
+		if err != nil {
+			log.Printf("ERROR - Unable to resolve secret flag: %s\n", err.Error())
+			os.Exit(1)
+		}
+		*secret = resolved
+	}
+
+	if err := parentCredentials().validate(); err != nil {
+		log.Printf("ERROR - Missing required flags: %s\n", err.Error())
+		flag.Usage()
+		os.Exit(1)
+	}
 }
 
 var BuildId string = "unset"
 
 func main() {
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		os.Exit(runSubcommand(os.Args[1], os.Args[2:]))
+	}
+
 	log.Printf("Starting mqttBridgeAdapter... BuildId: %s", BuildId)
 
 	flag.Usage = usage
@@ -106,60 +216,99 @@ func main() {
 
 	rand.Seed(time.Now().UnixNano())
 
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	initLogging()
 
-	filter := &logutils.LevelFilter{
-		Levels:   []logutils.LogLevel{"DEBUG", "INFO", "WARN", "ERROR", "FATAL"},
-		MinLevel: logutils.LogLevel(strings.ToUpper(logLevel)),
-		Writer:   os.Stdout,
-	}
-
-	log.SetOutput(filter)
 	//create map that stores sent messages, need this because we have no control of topic structure on other MQTT broker,
 	// so we can't break messages out into incoming/outgoing topics like the clearblade side does
 	cbSentMessages = SentMessages{
 		Mutex:    &sync.Mutex{},
 		Messages: make(map[SentKey]int),
 	}
+	// created once so messages delivered before we resubscribe on a persistent session reconnect are kept
+	cbSubChannel = make(chan mqtt.Message, 50)
 
-	var err error
+	initRecorder()
+	initTracing()
 
-	for err = initCbClient(); err != nil; {
-		log.Println("[ERROR] Failed to initialize Parent MQTT client, trying again in 20 seconds")
-		time.Sleep(time.Duration(time.Second * 20))
-		err = initCbClient()
+	if dryRun {
+		log.Println("[INFO] Running in dry run mode, messages will not be forwarded")
+		go dryRunSummaryOnExit()
 	}
 
-	for err = initOtherMQTT(); err != nil; {
-		log.Println("[ERROR] Failed to initialize other MQTT client, trying again in 20 seconds")
-		time.Sleep(time.Duration(time.Second * 20))
-		err = initOtherMQTT()
+	cbConnection = newConnectionManager(connectionClearBlade, initCbClient)
+	otherConnection = newConnectionManager(connectionExternal, initOtherMQTT)
+
+	var err error
+
+	cbConnection.restart(20*time.Second, 0)
+
+	go statusPublisher()
+	go telemetryWriter()
+	go tokenRefresher()
+
+	switch currentConfig().BrokerConfig.Mode {
+	case modeKafka:
+		for err = initKafka(); err != nil; {
+			log.Println("[ERROR] Failed to initialize Kafka client, trying again in 20 seconds")
+			time.Sleep(time.Duration(time.Second * 20))
+			err = initKafka()
+		}
+	case modeHTTP:
+		for err = initHTTP(); err != nil; {
+			log.Println("[ERROR] Failed to initialize HTTP bridge, trying again in 20 seconds")
+			time.Sleep(time.Duration(time.Second * 20))
+			err = initHTTP()
+		}
+	default:
+		otherConnection.restart(20*time.Second, 0)
 	}
 
 	c := make(chan struct{})
 	<-c
 }
 
-func cbMessageListener(ctx context.Context, onPubChannel <-chan *mqttTypes.Publish) {
+// runSubcommand runs a tool that doesn't start the bridge, returning the exit code
+func runSubcommand(name string, args []string) int {
+	switch name {
+	case "encrypt":
+		return runEncrypt(args)
+	case "validate":
+		return runValidate(args)
+	case "replay":
+		return runReplay(args)
+	default:
+		log.Printf("ERROR - Unknown command: %s\n", name)
+		return 1
+	}
+}
+
+func cbMessageListener(ctx context.Context, onPubChannel <-chan mqtt.Message) {
 	for {
 		select {
 		case message, ok := <-onPubChannel:
 			if ok {
 				// message published to cb broker
-				if len(message.Topic.Split) >= 3 {
-					log.Printf("[DEBUG] cbMessageListener - message received topic: %s message: %s\n", message.Topic.Whole, string(message.Payload))
-					topicToUse := strings.Join(message.Topic.Split[2:], "/")
-					//log.Printf("[DEBUG] cbSentMessages: %+v\n", cbSentMessages)
-					cbSentMessages.Mutex.Lock()
-					cbSentMessages.Messages[SentKey{topicToUse, string(message.Payload)}]++
-					cbSentMessages.Mutex.Unlock()
-					if config.BrokerConfig.Client != nil && config.BrokerConfig.Client.IsConnected() {
-						config.BrokerConfig.Client.Publish(topicToUse, qos, false, message.Payload)
+				msg := &bridgeMessage{
+					ID:          newCorrelationID(),
+					Direction:   directionOutgoing,
+					SourceTopic: message.Topic(),
+					Payload:     message.Payload(),
+					Qos:         message.Qos(),
+					Retained:    message.Retained(),
+				}
+				recordMessage(msg)
+				levels := strings.Split(msg.SourceTopic, "/")
+				if len(levels) >= 3 {
+					logReceivedMessage("cbMessageListener", msg)
+					msg.Topic = strings.Join(levels[2:], "/")
+					if outgoingWorkers != nil {
+						outgoingWorkers.dispatch(msg)
 					} else {
-						log.Println("Other Broker is not yet connected..")
+						handleOutgoing(msg)
 					}
 				} else {
-					log.Printf("[DEBUG] cbMessageListener - Unexpected topic for message from ClearBlade Broker: %s\n", message.Topic.Whole)
+					logMessage("DEBUG", "cbMessageListener", msg, "Unexpected topic for message from ClearBlade Broker")
+					sendToDeadLetter(directionOutgoing, msg.SourceTopic, msg.Payload, "unexpected topic")
 				}
 			}
 		case <-ctx.Done():
@@ -169,41 +318,272 @@ func cbMessageListener(ctx context.Context, onPubChannel <-chan *mqttTypes.Publi
 	}
 }
 
+// handleOutgoing forwards a message from ClearBlade, dead lettering it if it can't be forwarded
+func handleOutgoing(msg *bridgeMessage) {
+	span := startReceiveSpan(msg)
+	err := forwardOutgoing(msg)
+	if err == errForwardingPaused {
+		logMessage("DEBUG", "handleOutgoing", msg, "outgoing forwarding is paused, dropping message")
+	} else if err == errTopicDenied {
+		logMessage("WARN", "handleOutgoing", msg, "topic is not allowed by the outgoing filter, dropping message")
+		if deadLetterDenied() {
+			sendToDeadLetter(directionOutgoing, msg.SourceTopic, msg.Payload, err.Error())
+		}
+	} else if err != nil {
+		logMessage("ERROR", "handleOutgoing", msg, "failed to forward message: %s", err.Error())
+		deadLetterMessage(msg, err)
+	}
+	endSpan(span, err)
+}
+
 func otherMessageHandler(client mqtt.Client, msg mqtt.Message) {
+	message := &bridgeMessage{
+		ID:          newCorrelationID(),
+		Direction:   directionIncoming,
+		SourceTopic: msg.Topic(),
+		Topic:       remoteIncomingTopic(msg.Topic()),
+		Payload:     msg.Payload(),
+		Qos:         msg.Qos(),
+		Retained:    msg.Retained(),
+	}
+	recordMessage(message)
+
 	cbSentMessages.Mutex.Lock()
 	n := cbSentMessages.Messages[SentKey{msg.Topic(), string(msg.Payload())}]
 	if n == 1 {
 		delete(cbSentMessages.Messages, SentKey{msg.Topic(), string(msg.Payload())})
 		cbSentMessages.Mutex.Unlock()
-		log.Println("[DEBUG] otherMessageHandler - ignoring message because it came from clearblade")
+		incrementStat(statEchoSuppressed)
+		logMessage("DEBUG", "otherMessageHandler", message, "ignoring message because it came from clearblade")
 		return
 	} else if n > 1 {
 		cbSentMessages.Messages[SentKey{msg.Topic(), string(msg.Payload())}]--
 		cbSentMessages.Mutex.Unlock()
-		log.Println("[DEBUG] otherMessageHandler - ignoring message because it came from clearblade")
+		incrementStat(statEchoSuppressed)
+		logMessage("DEBUG", "otherMessageHandler", message, "ignoring message because it came from clearblade")
 		return
 	}
 	cbSentMessages.Mutex.Unlock()
-	log.Printf("[DEBUG] otherMessageHandler - message received topic: %s message: %s\n", msg.Topic(), string(msg.Payload()))
-	topicToUse := config.TopicRoot + "/incoming/" + msg.Topic()
+	logReceivedMessage("otherMessageHandler", message)
+
+	span := startReceiveSpan(message)
+	err := forwardIncoming(message)
+	if err == errForwardingPaused {
+		logMessage("DEBUG", "otherMessageHandler", message, "incoming forwarding is paused, dropping message")
+	} else if err != nil {
+		logMessage("ERROR", "otherMessageHandler", message, "failed to forward message to ClearBlade: %s", err.Error())
+		deadLetterMessage(message, err)
+	}
+	endSpan(span, err)
+}
+
+// forwardOutgoing sends a message received on {topic_root}/outgoing/... to the external side
+func forwardOutgoing(msg *bridgeMessage) error {
+	if isPaused(directionOutgoing) {
+		incrementStat(statOutgoingPaused)
+		recordRoutingDecision(msg, "", verdictPaused)
+		return errForwardingPaused
+	}
+	if err := reassembleChunk(msg); err == errChunkBuffered {
+		// nothing to forward until the last chunk arrives
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !outgoingTopicAllowed(msg.Topic) {
+		incrementStat(statOutgoingDenied)
+		if !deadLetterDenied() {
+			// dead lettered messages are recorded by sendToDeadLetter
+			recordRoutingDecision(msg, "", verdictDenied)
+		}
+		return errTopicDenied
+	}
+	out, err := transformMessage(msg)
+	if err != nil {
+		incrementStat(statOutgoingFailed)
+		return err
+	}
+	if dryRun {
+		destination, err := outgoingDestination(out.Topic, out.Compression)
+		if err != nil {
+			return err
+		}
+		recordRoutingDecision(out, destination, verdictForward)
+		return nil
+	}
+
+	span := startMessageSpan(out, "publish", trace.SpanKindProducer)
+	for _, payload := range out.payloads() {
+		if err = publishOutgoing(out.Topic, out.Compression, payload); err != nil {
+			break
+		}
+	}
+	endSpan(span, err)
+	if err != nil {
+		incrementStat(statOutgoingFailed)
+		return err
+	}
+	incrementStat(statOutgoingForwarded)
+	return nil
+}
+
+// transformMessage applies the payload transforms to a copy of a message before it is published. The received
+// message is left as is, so a retry transforms the original payload again and dead letters carry the original
+func transformMessage(received *bridgeMessage) (*bridgeMessage, error) {
+	msg := *received
+	msg.Transforms = append([]string(nil), received.Transforms...)
+	msg.Chunks = nil
+	msg.dedupKey, msg.dedupWindow = "", nil
+	span := startMessageSpan(&msg, "transform", trace.SpanKindInternal)
+
+	err := decompressPayload(&msg)
+	if err == nil {
+		err = decodePayload(&msg)
+	}
+	if err == nil {
+		err = dedupMessage(&msg)
+	}
+	if err == nil {
+		err = validatePayload(&msg)
+	}
+	if err == nil {
+		err = reshapePayload(&msg)
+	}
+	if err == nil {
+		injectTraceContext(&msg)
+		err = encodePayload(&msg)
+	}
+	if err == nil {
+		err = compressPayload(&msg)
+	}
+	if err == nil {
+		err = applyPayloadLimit(&msg)
+	}
+	if err != nil && err != errDuplicateMessage {
+		// the message wasn't forwarded, so it mustn't be dropped as a duplicate if it is sent again
+		forgetMessage(&msg)
+	}
+	endSpan(span, err)
+	return &msg, err
+}
+
+// publishOutgoing sends a payload to the external side. Compression is marked with a header in Kafka and HTTP
+// mode, so routes and webhooks are matched against the topic without the suffix
+func publishOutgoing(topic, compression string, payload []byte) error {
+	switch currentConfig().BrokerConfig.Mode {
+	case modeKafka:
+		return produceKafka(topic, compression, payload)
+	case modeHTTP:
+		return postWebhook(topic, compression, payload)
+	default:
+		if compression != "" {
+			topic += "/" + compression
+		}
+		brokerConfig := currentConfig().BrokerConfig
+		if brokerConfig.Client == nil || !brokerConfig.Client.IsConnected() {
+			return fmt.Errorf("other broker is not yet connected")
+		}
+		if brokerConfig.RemoteTopicRoot != "" {
+			// the remote system only sends us its outgoing topics, so there is no echo to suppress
+			brokerConfig.Client.Publish(remoteOutgoingTopic(topic), qos(), false, payload)
+			return nil
+		}
+		//log.Printf("[DEBUG] cbSentMessages: %+v\n", cbSentMessages)
+		cbSentMessages.Mutex.Lock()
+		cbSentMessages.Messages[SentKey{topic, string(payload)}]++
+		cbSentMessages.Mutex.Unlock()
+		brokerConfig.Client.Publish(topic, qos(), false, payload)
+		return nil
+	}
+}
+
+// outgoingDestination describes where publishOutgoing would send a message, without sending it
+func outgoingDestination(topic, compression string) (string, error) {
+	switch currentConfig().BrokerConfig.Mode {
+	case modeKafka:
+		route := findKafkaRoute(currentConfig().BrokerConfig.Kafka.Outgoing, topic)
+		if route == nil {
+			return "", fmt.Errorf("no Kafka route defined for topic %s", topic)
+		}
+		return "kafka:" + route.KafkaTopic, nil
+	case modeHTTP:
+		route := findWebhookRoute(topic)
+		if route == nil {
+			return "", fmt.Errorf("no webhook defined for topic %s", topic)
+		}
+		return webhookURL(route.URL, topic)
+	default:
+		if compression != "" {
+			topic += "/" + compression
+		}
+		if currentConfig().BrokerConfig.RemoteTopicRoot != "" {
+			return remoteOutgoingTopic(topic), nil
+		}
+		return topic, nil
+	}
+}
 
-	if token := cbMqttClient.Publish(topicToUse, qos, false, msg.Payload()); token.Error() != nil {
-		log.Printf("[ERROR] otherMessageHandler - failed to forward message to ClearBlade: %s\n", token.Error())
+// forwardIncoming publishes a message received from the external side to {topic_root}/incoming/{topic} on ClearBlade
+func forwardIncoming(msg *bridgeMessage) error {
+	if isPaused(directionIncoming) {
+		incrementStat(statIncomingPaused)
+		recordRoutingDecision(msg, "", verdictPaused)
+		return errForwardingPaused
+	}
+	if err := reassembleChunk(msg); err == errChunkBuffered {
+		// nothing to forward until the last chunk arrives
+		return nil
+	} else if err != nil {
+		return err
 	}
+	out, err := transformMessage(msg)
+	if err == errDuplicateMessage {
+		incrementStat(statDuplicatesDropped)
+		recordRoutingDecision(out, "", verdictDuplicate)
+		logMessage("DEBUG", "forwardIncoming", msg, "dropping duplicate message")
+		return nil
+	} else if err != nil {
+		incrementStat(statIncomingFailed)
+		return err
+	}
+	topicToUse := currentConfig().TopicRoot + "/incoming/" + out.Topic
+	if dryRun {
+		recordRoutingDecision(out, topicToUse, verdictForward)
+		return nil
+	}
+
+	span := startMessageSpan(out, "publish", trace.SpanKindProducer)
+	for _, payload := range out.payloads() {
+		if token := cbMqttClient.Publish(topicToUse, qos(), false, payload); token.Wait() && token.Error() != nil {
+			err = &publishError{token.Error()}
+			break
+		}
+	}
+	endSpan(span, err)
+	if err != nil {
+		forgetMessage(out)
+		incrementStat(statIncomingFailed)
+		return err
+	}
+	incrementStat(statIncomingForwarded)
+	return nil
 }
 
-func initCbClient() error {
-	cbClient = cb.NewDeviceClientWithAddrs(platformURL, messagingURL, sysKey, sysSec, deviceName, activeKey)
+func initCbClient() (mqtt.Client, error) {
+	deviceClient := newCbClient(parentCredentials())
 
-	log.Println("[INFO] initCbClient - Authenticating with ClearBlade")
-	for _, err := cbClient.Authenticate(); err != nil; {
+	log.Printf("[INFO] initCbClient - Authenticating with ClearBlade using %s auth\n", authType)
+	for err := authenticateCbClient(deviceClient); err != nil; {
 		log.Printf("[ERROR] initCbClient - Error authenticating ClearBlade: %s\n", err.Error())
 		time.Sleep(time.Duration(time.Second * 1)) //TODO 10 to 1
-		_, err = cbClient.Authenticate()
+		err = authenticateCbClient(deviceClient)
 	}
+	// only shared once authenticated, so the token refresher never authenticates it at the same time
+	setCbClient(deviceClient)
 
 	log.Println("[INFO] initCbClient - Fetching adapter config")
-	setAdapterConfig(cbClient)
+	setAdapterConfig(deviceClient)
+	startOutgoingWorkers()
 
 	log.Println("[INFO] initCbClient - Init Connection to Parent Edge")
 
@@ -211,16 +591,23 @@ func initCbClient() error {
 
 	opts.AddBroker(messagingURL)
 
-	if cbClient.DeviceToken == "" || cbClient.SystemKey == "" {
-		return fmt.Errorf("[ERROR] initCbClient - DeviceToken or SystemKey not set")
+	cbToken := cbClientToken(deviceClient)
+	if cbToken == "" || sysKey == "" {
+		return nil, fmt.Errorf("[ERROR] initCbClient - Token or SystemKey not set")
 	}
-	opts.SetUsername(cbClient.DeviceToken)
-	opts.SetPassword(cbClient.SystemKey)
-	opts.SetClientID(deviceName + "-" + strconv.Itoa(randomInt(0, 10000)))
+	opts.SetUsername(cbToken)
+	opts.SetPassword(sysKey)
+	clientID := cbClientID
+	if clientID == "" {
+		clientID = defaultClientID("")
+	}
+	opts.SetClientID(clientID)
+	opts.SetWill(statusTopic(), string(offlineStatus()), qos(), true)
 	opts.SetOnConnectHandler(onCBConnect)
 	opts.SetConnectionLostHandler(onCBDisconnect)
+	opts.SetDefaultPublishHandler(cbMessageHandler)
 	opts.SetAutoReconnect(false)
-	opts.SetCleanSession(true)
+	setSessionOptions(opts, clientID, persistentSession)
 	opts.SetKeepAlive(10 * time.Second)
 	opts.SetPingTimeout(10 * time.Second)
 	opts.SetConnectTimeout(8 * time.Second)
@@ -228,11 +615,16 @@ func initCbClient() error {
 	//log.Println("Options before creating client:")
 	//log.Println(opts)
 
-	cbMqttClient = mqtt.NewClient(opts)
+	client := mqtt.NewClient(opts)
+	cbMqttClient = client
 
-	if token := cbMqttClient.Connect(); token.Wait() && token.Error() != nil {
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
 		log.Printf("[ERROR] initCbClient - Unable to connect to other MQTT Broker: %s", token.Error())
-		return token.Error()
+		if isAuthError(token) {
+			// initCbClient authenticates again each time it is called, so the next attempt uses a new token
+			log.Println("[WARN] initCbClient - ClearBlade rejected the token, re-authenticating on next attempt")
+		}
+		return nil, token.Error()
 	}
 	log.Println("[INFO] initCbClient - Parent Edge MQTT Connected")
 
@@ -240,36 +632,45 @@ func initCbClient() error {
 	// if err := cbClient.InitializeMQTTWithCallback(deviceName+"-"+strconv.Itoa(randomInt(0, 10000)), "", 30, nil, nil, &callbacks); err != nil {
 	// 	log.Fatalf("[FATAL] initCbClient - Unable to initialize MQTT connection with ClearBlade: %s", err.Error())
 	// }
-	return nil
+	return client, nil
 
 }
 
-func initOtherMQTT() error {
+func initOtherMQTT() (mqtt.Client, error) {
 	log.Println("[INFO] initOtherMQTT - Initializing Other MQTT")
 
-	if config.BrokerConfig.IsCbBroker {
+	brokerConfig := currentConfig().BrokerConfig
+	username, password := brokerConfig.Username, brokerConfig.Password
+	if brokerConfig.IsCbBroker {
+		// authenticate on every connect so we never reuse a stale token
 		if err := initOtherCbClient(); err != nil {
-			return err
+			return nil, err
 		}
+		username, password = otherCbCredentials()
 	}
 
 	opts := mqtt.NewClientOptions()
 
-	opts.AddBroker(config.BrokerConfig.MessagingURL)
+	opts.AddBroker(brokerConfig.MessagingURL)
 
-	if config.BrokerConfig.Username != "" {
-		opts.SetUsername(config.BrokerConfig.Username)
+	if username != "" {
+		opts.SetUsername(username)
 	}
 
-	if config.BrokerConfig.Password != "" {
-		opts.SetPassword(config.BrokerConfig.Password)
+	if password != "" {
+		opts.SetPassword(password)
 	}
 
-	opts.SetClientID(deviceName + "-" + strconv.Itoa(randomInt(0, 10000)))
+	clientID := brokerConfig.ClientID
+	if clientID == "" {
+		clientID = defaultClientID("-external")
+	}
+	opts.SetClientID(clientID)
 	opts.SetOnConnectHandler(onOtherConnect)
 	opts.SetConnectionLostHandler(onOtherDisconnect)
+	opts.SetDefaultPublishHandler(otherMessageHandler)
 	opts.SetAutoReconnect(false)
-	opts.SetCleanSession(true)
+	setSessionOptions(opts, clientID, brokerConfig.PersistentSession)
 	opts.SetKeepAlive(10 * time.Second)
 	opts.SetPingTimeout(10 * time.Second)
 	opts.SetConnectTimeout(8 * time.Second)
@@ -281,93 +682,151 @@ func initOtherMQTT() error {
 
 	if token := client.Connect(); token.Wait() && token.Error() != nil {
 		log.Printf("[ERROR] initOtherMQTT - Unable to connect to other MQTT Broker: %s", token.Error())
-		return token.Error()
+		if brokerConfig.IsCbBroker && isAuthError(token) {
+			// initOtherCbClient authenticates again each time it is called, so the next attempt uses a new token
+			log.Println("[WARN] initOtherMQTT - External ClearBlade rejected the token, re-authenticating on next attempt")
+		}
+		return nil, token.Error()
 	}
 	log.Println("[INFO] initOtherMQTT - Other MQTT Connected")
-	return nil
+	return client, nil
 }
 
-func initOtherCbClient() error {
-	client := cb.NewDeviceClientWithAddrs(config.BrokerConfig.PlatformURL,
-		config.BrokerConfig.MessagingURL,
-		config.BrokerConfig.SystemKey,
-		config.BrokerConfig.SystemSecret,
-		config.BrokerConfig.DeviceName,
-		config.BrokerConfig.ActiveKey)
-
-	log.Println("[INFO] initOtherCbClient - Authenticating with ClearBlade")
+// remoteOutgoingTopic is the topic on a remote ClearBlade system that outgoing messages are published to
+func remoteOutgoingTopic(topic string) string {
+	return currentConfig().BrokerConfig.RemoteTopicRoot + "/incoming/" + topic
+}
 
-	if config.BrokerConfig.Username != "" && config.BrokerConfig.Password != "" {
-		return nil
+// remoteIncomingTopic trims {remoteTopicRoot}/outgoing from topics received from a remote ClearBlade system
+func remoteIncomingTopic(topic string) string {
+	if currentConfig().BrokerConfig.RemoteTopicRoot == "" {
+		return topic
 	}
+	return strings.TrimPrefix(topic, currentConfig().BrokerConfig.RemoteTopicRoot+"/outgoing/")
+}
+
+func initOtherCbClient() error {
+	creds := otherCredentials(currentConfig().BrokerConfig)
+	client := newCbClient(creds)
 
-	if _, err := client.Authenticate(); err != nil {
+	log.Printf("[INFO] initOtherCbClient - Authenticating with ClearBlade using %s auth\n", creds.AuthType)
+
+	if err := authenticateCbClient(client); err != nil {
 		log.Printf("[ERROR] initOtherCbClient - Error authenticating ClearBlade: %s\n", err.Error())
 		return err
 	}
-	// Set Auth username password for standard mqtt auth
-	config.BrokerConfig.Username = client.DeviceToken
-	config.BrokerConfig.Password = client.SystemKey
+	// Set Auth username password for standard mqtt auth, kept apart from the adapter_settings credentials
+	setOtherCbClient(client)
 	return nil
 }
 
+// setAdapterConfig loads the adapter config each time ClearBlade connects. Only the first load is fatal, after
+// that a config that fails to load or validate is logged and the last good config is kept, like reloadConfig
 func setAdapterConfig(client cb.Client) {
-	log.Println("[INFO] setAdapterConfig - Fetching adapter config")
-
-	query := cb.NewQuery()
-	query.EqualTo("adapter_name", deviceName)
-
-	log.Println("[DEBUG] setAdapterConfig - Executing query against table " + adapterConfigCollID)
-	results, err := client.GetData(adapterConfigCollID, query)
+	newConfig, err := loadAdapterConfig(client)
+	if currentConfig().Version == "" {
+		if err != nil {
+			log.Fatalf("[FATAL] setAdapterConfig - %s", err.Error())
+		}
+	} else if err == nil {
+		err = checkReloadable(newConfig)
+	}
 	if err != nil {
-		log.Fatalf("[FATAL] setAdapterConfig - Error fetching adapter config: %s", err.Error())
+		log.Printf("[ERROR] setAdapterConfig - Keeping current config: %s\n", err.Error())
+		return
 	}
+	setConfig(newConfig)
 
-	data := results["DATA"].([]interface{})
+	log.Printf("[DEBUG] setAdapterConfig - Using adapter settings:\n%+v\n", redactedConfig(newConfig))
+}
 
-	if len(data) == 0 {
-		log.Fatalf("[FATAL] - setAdapterConfig - No configuration found for adapter with name: %s", deviceName)
-	}
+// currentConfig returns the adapter config in use
+func currentConfig() adapterConfig {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	return config
+}
+
+// setConfig replaces the adapter config, keeping the existing external client, which is only replaced when the
+// external broker reconnects
+func setConfig(newConfig adapterConfig) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	newConfig.BrokerConfig.Client = config.BrokerConfig.Client
+	config = newConfig
+}
 
-	config = adapterConfig{TopicRoot: "mqtt-bridge-adapter"}
+// setExternalClient replaces the external client in the adapter config
+func setExternalClient(client mqtt.Client) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	config.BrokerConfig.Client = client
+}
+
+// qos returns the qos to use for all subs and pubs, set from adapter_settings
+func qos() byte {
+	return byte(currentConfig().BrokerConfig.QoS)
+}
+
+// loadAdapterConfig fetches and parses the adapter config from the adapter config collection
+func loadAdapterConfig(client cb.Client) (adapterConfig, error) {
+	log.Println("[INFO] loadAdapterConfig - Fetching adapter config")
+
+	configData, err := fetchAdapterConfigRow(client)
+	if err != nil {
+		return adapterConfig{}, err
+	}
+	log.Printf("[DEBUG] loadAdapterConfig - fetched config for adapter: %v, topic_root: %v\n", configData["adapter_name"], configData["topic_root"])
 
-	configData := data[0].(map[string]interface{})
-	log.Printf("[DEBUG] setAdapterConfig - fetched config:\n%+v\n", data)
-	if configData["topic_root"] != nil {
-		config.TopicRoot = configData["topic_root"].(string)
+	newConfig, problems := parseAdapterConfig(configData)
+	problems, warnings := splitWarnings(problems)
+	for _, warning := range warnings {
+		log.Printf("[WARN] loadAdapterConfig - Ignoring %s\n", warning.Error())
 	}
-	if configData["adapter_settings"] == nil {
-		log.Fatalln("[FATAL] setAdapterConfig - No adapter settings required, this is required")
+	if len(problems) > 0 {
+		return adapterConfig{}, configProblemsError(problems)
 	}
-	var bC mqttBroker
-	if err := json.Unmarshal([]byte(configData["adapter_settings"].(string)), &bC); err != nil {
-		log.Fatalf("[FATAL] setAdapterConfig - Failed to parse adapter_settings: %s", err.Error())
+	return newConfig, nil
+}
+
+// fetchAdapterConfigRow returns the row for this adapter from the adapter config collection
+func fetchAdapterConfigRow(client cb.Client) (map[string]interface{}, error) {
+	query := cb.NewQuery()
+	query.EqualTo("adapter_name", deviceName)
+
+	log.Println("[DEBUG] fetchAdapterConfigRow - Executing query against table " + adapterConfigCollID)
+	results, err := client.GetData(adapterConfigCollID, query)
+	if err != nil {
+		return nil, fmt.Errorf("Error fetching adapter config: %s", err.Error())
 	}
 
-	config.BrokerConfig = bC
+	data, ok := results["DATA"].([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Unexpected response fetching adapter config: %+v", results)
+	}
 
-	if config.BrokerConfig.MessagingURL == "" {
-		log.Fatalln("[FATAL] setAdapterConfig - No messaging URL defined for broker config adapter_settings")
+	if len(data) == 0 {
+		return nil, fmt.Errorf("No configuration found for adapter with name: %s", deviceName)
 	}
 
-	log.Printf("[DEBUG] setAdapterConfig - Using adapter settings:\n%+v\n", config)
+	configData, ok := data[0].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Unexpected adapter config row: %+v", data[0])
+	}
+	return configData, nil
 }
 
 func onCBConnect(client mqtt.Client) {
 	log.Println("[DEBUG] onCBConnect - ClearBlade MQTT connected")
+	setConnected(connectionClearBlade, true)
 
 	// subscribe
 	//on cb we subscribe to all outgoing topics prefaced with topic root
 	log.Println("[INFO] Subscribing to outgoing clearblade topic")
-	outgoingTopic := config.TopicRoot + "/outgoing/#"
+	outgoingTopic := currentConfig().TopicRoot + "/outgoing/#"
 	log.Println("Topic root: " + outgoingTopic)
 
-	cbSubChannel := make(chan *mqttTypes.Publish, 50)
-
-	ret := client.Subscribe(outgoingTopic, uint8(qos), func(c mqtt.Client, msg mqtt.Message) {
-		path, _ := mqttTypes.NewTopicPath(msg.Topic())
-		cbSubChannel <- &mqttTypes.Publish{Topic: path, Payload: msg.Payload()}
-	})
+	ret := client.Subscribe(outgoingTopic, qos(), cbMessageHandler)
 
 	ret.WaitTimeout(1 * time.Second)
 	if ret.Error() != nil {
@@ -375,34 +834,53 @@ func onCBConnect(client mqtt.Client) {
 		return
 	}
 
-	cbCtx, cbCancelCtx = context.WithCancel(context.Background())
-	go cbMessageListener(cbCtx, cbSubChannel)
+	// replaces the listener started by the previous connection, if it is still running
+	cbConnection.startListener(func(ctx context.Context) {
+		cbMessageListener(ctx, cbSubChannel)
+	})
 
+	log.Println("[INFO] Subscribing to control topic: " + controlTopic())
+	if ret := client.Subscribe(controlTopic(), qos(), controlMessageHandler); ret.WaitTimeout(1*time.Second) && ret.Error() != nil {
+		log.Printf("[ERROR] onCBConnect - Control topic subscribe error %s\n", ret.Error())
+	}
+}
+
+// cbMessageHandler passes messages from ClearBlade to cbMessageListener, it is also the default handler
+// for messages delivered from a persistent session before we have resubscribed
+func cbMessageHandler(client mqtt.Client, msg mqtt.Message) {
+	if msg.Topic() == controlTopic() {
+		controlMessageHandler(client, msg)
+		return
+	}
+	cbSubChannel <- msg
 }
 
 func onCBDisconnect(client mqtt.Client, err error) {
 	log.Printf("[DEBUG] onCBDisonnect - ClearBlade MQTT disconnected: %s", err.Error())
-	cbCancelCtx()
+	setConnected(connectionClearBlade, false)
 
-	for errInit := initCbClient(); errInit != nil; {
-		log.Println("[ERROR] Failed to initialize Parent MQTT client, trying again every 1 second until successful")
-		time.Sleep(time.Duration(time.Second * 1))
-		errInit = initCbClient()
+	if cbConnection.connectionLost(client, time.Second) {
+		incrementStat(statCbReconnects)
 	}
 }
 
 func onOtherConnect(client mqtt.Client) {
 	log.Println("[DEBUG] onOtherConnect - Other MQTT connected")
 	// Reset the OtherBroker Client on Reconnect
-	config.BrokerConfig.Client = client
+	setExternalClient(client)
+	setConnected(connectionExternal, true)
 	//on other mqtt we subscribe to the provided topics, or all topics if nothing is provided
-	if len(config.BrokerConfig.Topics) == 0 {
+	brokerConfig := currentConfig().BrokerConfig
+	if len(brokerConfig.Topics) == 0 && brokerConfig.RemoteTopicRoot != "" {
+		log.Println("[INFO] No topics provided, subscribing to remote system outgoing topics")
+		client.Subscribe(brokerConfig.RemoteTopicRoot+"/outgoing/#", qos(), otherMessageHandler)
+	} else if len(brokerConfig.Topics) == 0 {
 		log.Println("[INFO] No topics provided, subscribing to all topics for other MQTT broker")
-		client.Subscribe("#", qos, otherMessageHandler)
+		client.Subscribe("#", qos(), otherMessageHandler)
 	} else {
-		log.Printf("[INFO] Subscribing to remote topics: %+v\n", config.BrokerConfig.Topics)
-		for _, element := range config.BrokerConfig.Topics {
-			client.Subscribe(element, qos, otherMessageHandler)
+		log.Printf("[INFO] Subscribing to remote topics: %+v\n", brokerConfig.Topics)
+		for _, element := range brokerConfig.Topics {
+			client.Subscribe(element, qos(), otherMessageHandler)
 		}
 	}
 
@@ -410,11 +888,48 @@ func onOtherConnect(client mqtt.Client) {
 
 func onOtherDisconnect(client mqtt.Client, err error) {
 	log.Printf("[DEBUG] onOtherConnect - Other MQTT disconnected: %s", err.Error())
+	setConnected(connectionExternal, false)
+
+	if otherConnection.connectionLost(client, time.Second) {
+		incrementStat(statExternalReconnects)
+	}
+}
+
+// defaultClientID returns a client ID that stays the same across reconnects and restarts
+func defaultClientID(suffix string) string {
+	return deviceName + "-" + adapterInstanceID() + suffix
+}
+
+// adapterInstanceID returns an id unique to this installation of the adapter. It is generated the first time the
+// adapter runs and kept in the store directory, as gateways built from the same image can share a hostname
+func adapterInstanceID() string {
+	instanceIDOnce.Do(func() {
+		path := filepath.Join(storeDirectory, instanceIDFile)
+		if data, err := ioutil.ReadFile(path); err == nil && len(bytes.TrimSpace(data)) > 0 {
+			instanceID = string(bytes.TrimSpace(data))
+			return
+		}
+
+		id := make([]byte, 6)
+		if _, err := crand.Read(id); err != nil {
+			log.Fatalf("[FATAL] adapterInstanceID - Unable to generate an instance id: %s", err.Error())
+		}
+		instanceID = hex.EncodeToString(id)
+		if err := os.MkdirAll(storeDirectory, 0700); err != nil {
+			log.Printf("[WARN] adapterInstanceID - Unable to create %s, the client ID will change when the adapter restarts: %s\n", storeDirectory, err.Error())
+		} else if err := ioutil.WriteFile(path, []byte(instanceID+"\n"), 0600); err != nil {
+			log.Printf("[WARN] adapterInstanceID - Unable to save the instance id, the client ID will change when the adapter restarts: %s\n", err.Error())
+		}
+	})
+	return instanceID
+}
 
-	for err = initOtherMQTT(); err != nil; {
-		log.Println("[ERROR] Failed to initialize other MQTT client, trying again in 1 seconds")
-		time.Sleep(time.Duration(time.Second * 1))
-		err = initOtherMQTT()
+// setSessionOptions configures a clean session, or a persistent session backed by a file store so in flight
+// QoS 1 and 2 messages survive reconnects and restarts
+func setSessionOptions(opts *mqtt.ClientOptions, clientID string, persistent bool) {
+	opts.SetCleanSession(!persistent)
+	if persistent {
+		opts.SetStore(mqtt.NewFileStore(filepath.Join(storeDirectory, clientID)))
 	}
 }
 
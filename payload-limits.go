@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	payloadActionDrop     = "drop"
+	payloadActionTruncate = "truncate"
+	payloadActionChunk    = "chunk"
+
+	// chunks start with a header line: chunk-v1 <message id> <index> <count>
+	chunkHeaderPrefix = "chunk-v1 "
+	maxChunkHeaderLen = 64
+	chunkTimeout      = 60 * time.Second
+	maxChunkCount     = 10000
+
+	// limits on incomplete messages, the oldest are dropped to make room so a sender can't exhaust memory
+	maxChunkBufferBytes = 64 << 20
+	maxChunkBuffers     = 100
+)
+
+var (
+	errChunkBuffered = errors.New("waiting for the remaining chunks")
+
+	chunkBuffers = chunkReassembler{buffers: make(map[string]*chunkBuffer)}
+)
+
+// payloadTooLargeError is returned for a payload over the limit that can't be forwarded
+type payloadTooLargeError struct {
+	reason string
+}
+
+func (e *payloadTooLargeError) Error() string {
+	return e.reason
+}
+
+type payloadLimitsConfig struct {
+	Outgoing *payloadLimit `json:"outgoing"`
+	Incoming *payloadLimit `json:"incoming"`
+}
+
+// payloadLimit is the largest payload forwarded in one direction, and what to do with larger payloads
+type payloadLimit struct {
+	MaxBytes int    `json:"maxBytes"`
+	Action   string `json:"action"` // drop (default), truncate or chunk
+}
+
+func directionPayloadLimit(direction string) *payloadLimit {
+	limits := currentConfig().BrokerConfig.PayloadLimits
+	if limits == nil {
+		return nil
+	}
+	if direction == directionOutgoing {
+		return limits.Outgoing
+	}
+	return limits.Incoming
+}
+
+// chunkingEnabled reports whether either direction splits payloads, in which case chunks received in either
+// direction are reassembled
+func chunkingEnabled() bool {
+	for _, direction := range []string{directionOutgoing, directionIncoming} {
+		if limit := directionPayloadLimit(direction); limit != nil && limit.Action == payloadActionChunk {
+			return true
+		}
+	}
+	return false
+}
+
+// applyPayloadLimit drops, truncates or splits a payload larger than the limit for the message's direction
+func applyPayloadLimit(msg *bridgeMessage) error {
+	limit := directionPayloadLimit(msg.Direction)
+	if limit == nil || limit.MaxBytes <= 0 || len(msg.Payload) <= limit.MaxBytes {
+		return nil
+	}
+	incrementStat(statOversizedPayloads)
+
+	switch limit.Action {
+	case payloadActionTruncate:
+		msg.Payload = msg.Payload[:limit.MaxBytes]
+		msg.Transforms = append(msg.Transforms, payloadActionTruncate)
+	case payloadActionChunk:
+		// the index and count can't have more digits than the payload length
+		headerLen := len(chunkHeaderPrefix) + len(msg.ID) + 2*len(strconv.Itoa(len(msg.Payload))) + 3
+		chunkSize := limit.MaxBytes - headerLen
+		if count := (len(msg.Payload) + chunkSize - 1) / chunkSize; count > maxChunkCount {
+			return &payloadTooLargeError{fmt.Sprintf("payload of %d bytes needs %d chunks, the most a payload can be split into is %d", len(msg.Payload), count, maxChunkCount)}
+		}
+		msg.Chunks = splitPayload(msg.ID, msg.Payload, chunkSize)
+		msg.Transforms = append(msg.Transforms, payloadActionChunk)
+	default:
+		return &payloadTooLargeError{fmt.Sprintf("payload of %d bytes exceeds the %s limit of %d bytes", len(msg.Payload), msg.Direction, limit.MaxBytes)}
+	}
+	return nil
+}
+
+func splitPayload(id string, payload []byte, chunkSize int) [][]byte {
+	count := (len(payload) + chunkSize - 1) / chunkSize
+	chunks := make([][]byte, 0, count)
+	for index := 0; index < count; index++ {
+		end := (index + 1) * chunkSize
+		if end > len(payload) {
+			end = len(payload)
+		}
+		header := fmt.Sprintf("%s%s %d %d\n", chunkHeaderPrefix, id, index, count)
+		chunks = append(chunks, append([]byte(header), payload[index*chunkSize:end]...))
+	}
+	return chunks
+}
+
+// parseChunkHeader returns the message id, index and count from a chunk, ok is false if payload is not a chunk
+func parseChunkHeader(payload []byte) (id string, index, count int, data []byte, ok bool) {
+	if !bytes.HasPrefix(payload, []byte(chunkHeaderPrefix)) {
+		return "", 0, 0, nil, false
+	}
+	end := bytes.IndexByte(payload, '\n')
+	if end < 0 || end > maxChunkHeaderLen {
+		return "", 0, 0, nil, false
+	}
+	fields := strings.Fields(string(payload[len(chunkHeaderPrefix):end]))
+	if len(fields) != 3 {
+		return "", 0, 0, nil, false
+	}
+	index, indexErr := strconv.Atoi(fields[1])
+	count, countErr := strconv.Atoi(fields[2])
+	if indexErr != nil || countErr != nil || count < 1 || count > maxChunkCount || index < 0 || index >= count {
+		return "", 0, 0, nil, false
+	}
+	return fields[0], index, count, payload[end+1:], true
+}
+
+// chunkReassembler collects chunks until every chunk of a message has been received
+type chunkReassembler struct {
+	sync.Mutex
+	buffers map[string]*chunkBuffer
+	size    int // bytes buffered across all buffers
+}
+
+type chunkBuffer struct {
+	parts    [][]byte
+	received int
+	size     int
+	started  time.Time
+}
+
+// drop removes a buffer, must be called with the lock held
+func (r *chunkReassembler) drop(key string) {
+	if buffer, ok := r.buffers[key]; ok {
+		r.size -= buffer.size
+		delete(r.buffers, key)
+	}
+}
+
+// dropOldest removes the buffer that was started first other than keep, returning false if there is none,
+// must be called with the lock held
+func (r *chunkReassembler) dropOldest(keep string) bool {
+	oldestKey := ""
+	var oldest *chunkBuffer
+	for key, buffer := range r.buffers {
+		if key != keep && (oldest == nil || buffer.started.Before(oldest.started)) {
+			oldestKey, oldest = key, buffer
+		}
+	}
+	if oldest == nil {
+		return false
+	}
+	log.Printf("[WARN] reassembleChunk - Too many chunks buffered, dropping incomplete message after receiving %d of %d chunks\n", oldest.received, len(oldest.parts))
+	r.drop(oldestKey)
+	return true
+}
+
+// reassembleChunk buffers msg if it is a chunk, returning errChunkBuffered until the last chunk arrives, when
+// msg.Payload is replaced with the whole payload. Messages that are not chunks are left unchanged
+func reassembleChunk(msg *bridgeMessage) error {
+	if !chunkingEnabled() {
+		return nil
+	}
+	id, index, count, data, ok := parseChunkHeader(msg.Payload)
+	if !ok {
+		return nil
+	}
+	key := msg.Direction + "\n" + msg.SourceTopic + "\n" + id
+
+	chunkBuffers.Lock()
+	defer chunkBuffers.Unlock()
+
+	now := time.Now()
+	for bufferKey, buffer := range chunkBuffers.buffers {
+		if now.Sub(buffer.started) > chunkTimeout {
+			log.Printf("[WARN] reassembleChunk - Dropping incomplete message after receiving %d of %d chunks\n", buffer.received, len(buffer.parts))
+			chunkBuffers.drop(bufferKey)
+		}
+	}
+
+	buffer, exists := chunkBuffers.buffers[key]
+	if !exists {
+		for len(chunkBuffers.buffers) >= maxChunkBuffers && chunkBuffers.dropOldest(key) {
+		}
+		buffer = &chunkBuffer{parts: make([][]byte, count), started: now}
+		chunkBuffers.buffers[key] = buffer
+	}
+	if len(buffer.parts) != count {
+		chunkBuffers.drop(key)
+		return fmt.Errorf("chunk %d of message %s has a count of %d, expected %d", index, id, count, len(buffer.parts))
+	}
+	if buffer.parts[index] == nil {
+		for chunkBuffers.size+len(data) > maxChunkBufferBytes && chunkBuffers.dropOldest(key) {
+		}
+		if chunkBuffers.size+len(data) > maxChunkBufferBytes {
+			chunkBuffers.drop(key)
+			return &payloadTooLargeError{fmt.Sprintf("chunked message %s is larger than the %d bytes that can be buffered", id, maxChunkBufferBytes)}
+		}
+		buffer.parts[index] = data
+		buffer.received++
+		buffer.size += len(data)
+		chunkBuffers.size += len(data)
+	}
+	if buffer.received < count {
+		return errChunkBuffered
+	}
+
+	chunkBuffers.drop(key)
+	msg.Payload = bytes.Join(buffer.parts, nil)
+	msg.Transforms = append(msg.Transforms, "reassemble")
+	return nil
+}
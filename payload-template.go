@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+var payloadTemplateFuncs = template.FuncMap{
+	"json":    templateJSON,
+	"flatten": flattenFields,
+}
+
+// payloadTemplateData is available to route templates, e.g. {"device": {{json (.Level 2)}}, "temp": {{json .Payload.t}}}
+type payloadTemplateData struct {
+	Topic      string
+	Levels     []string
+	Payload    interface{} // the payload decoded as JSON, nil if it isn't JSON
+	Raw        string      // the payload as received
+	Direction  string
+	ID         string
+	DeviceName string
+	Timestamp  string // RFC 3339, when the template was applied
+}
+
+// Level returns the 1 based level of the topic
+func (d payloadTemplateData) Level(level int) string {
+	return topicLevel(d.Topic, level)
+}
+
+// compilePayloadTemplate compiles a route's template, returning nil if the route doesn't have one
+func compilePayloadTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		return nil, nil
+	}
+	return template.New("payload").Funcs(payloadTemplateFuncs).Parse(text)
+}
+
+// reshapePayload replaces the payload of messages on routes with a template with the template's output
+func reshapePayload(msg *bridgeMessage) error {
+	route := findRoute(msg.Direction, msg.Topic)
+	if route == nil || route.compiledTemplate == nil {
+		return nil
+	}
+
+	data := payloadTemplateData{
+		Topic:      msg.Topic,
+		Levels:     strings.Split(msg.Topic, "/"),
+		Raw:        string(msg.Payload),
+		Direction:  msg.Direction,
+		ID:         msg.ID,
+		DeviceName: deviceName,
+		Timestamp:  time.Now().UTC().Format(time.RFC3339),
+	}
+	decoder := json.NewDecoder(bytes.NewReader(msg.Payload))
+	decoder.UseNumber() // keeps integers exact when they are written back out
+	if err := decoder.Decode(&data.Payload); err != nil {
+		data.Payload = nil
+	}
+
+	var payload bytes.Buffer
+	if err := route.compiledTemplate.Execute(&payload, data); err != nil {
+		return fmt.Errorf("failed to apply the template for route %s: %s", route.Topic, err.Error())
+	}
+	msg.Payload = payload.Bytes()
+	msg.Transforms = append(msg.Transforms, "template")
+	return nil
+}
+
+// templateJSON writes a value as JSON, so strings are quoted and escaped and missing fields are null
+func templateJSON(value interface{}) (string, error) {
+	encoded, err := json.Marshal(value)
+	return string(encoded), err
+}
+
+// flattenFields returns the nested objects and arrays in a value as a single object with dotted keys,
+// e.g. {"a": {"b": 1}, "c": [2]} becomes {"a.b": 1, "c.0": 2}
+func flattenFields(value interface{}) map[string]interface{} {
+	fields := map[string]interface{}{}
+	var flatten func(prefix string, value interface{})
+	flatten = func(prefix string, value interface{}) {
+		join := func(key string) string {
+			if prefix == "" {
+				return key
+			}
+			return prefix + "." + key
+		}
+		switch v := value.(type) {
+		case map[string]interface{}:
+			for key, field := range v {
+				flatten(join(key), field)
+			}
+		case []interface{}:
+			for i, element := range v {
+				flatten(join(strconv.Itoa(i)), element)
+			}
+		default:
+			fields[prefix] = value
+		}
+	}
+	flatten("", value)
+	return fields
+}
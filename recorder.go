@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	mqtt "github.com/clearblade/paho.mqtt.golang"
+)
+
+var (
+	recordFile      string
+	recordMaxSizeMB int
+	recordMaxFiles  int
+	recorder        *messageRecorder
+)
+
+// recordedMessage is one line of a recording
+type recordedMessage struct {
+	Timestamp time.Time `json:"timestamp"`
+	Direction string    `json:"direction"`
+	Topic     string    `json:"topic"`
+	QoS       byte      `json:"qos"`
+	Retain    bool      `json:"retain"`
+	Payload   []byte    `json:"payload"` // base64 encoded
+}
+
+// messageRecorder writes newline delimited JSON to path, when the file reaches maxSize it is rotated to
+// path.1, path.1 to path.2 and so on, keeping at most maxFiles old files
+type messageRecorder struct {
+	sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+func openRecorder(path string, maxSize int64, maxFiles int) (*messageRecorder, error) {
+	r := &messageRecorder{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *messageRecorder) open() error {
+	file, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("unable to open recording file: %s", err.Error())
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("unable to stat recording file: %s", err.Error())
+	}
+	r.file = file
+	r.size = info.Size()
+	return nil
+}
+
+func (r *messageRecorder) rotate() error {
+	r.file.Close()
+	for i := r.maxFiles - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+	}
+	if r.maxFiles > 0 {
+		if err := os.Rename(r.path, r.path+".1"); err != nil {
+			return fmt.Errorf("unable to rotate recording file: %s", err.Error())
+		}
+	} else if err := os.Remove(r.path); err != nil {
+		return fmt.Errorf("unable to rotate recording file: %s", err.Error())
+	}
+	return r.open()
+}
+
+func (r *messageRecorder) record(msg *bridgeMessage) {
+	line, err := json.Marshal(recordedMessage{
+		Timestamp: time.Now().UTC(),
+		Direction: msg.Direction,
+		Topic:     msg.SourceTopic,
+		QoS:       msg.Qos,
+		Retain:    msg.Retained,
+		Payload:   msg.Payload,
+	})
+	if err != nil {
+		log.Printf("[ERROR] messageRecorder - Failed to record message on topic %s: %s\n", msg.SourceTopic, err.Error())
+		return
+	}
+	line = append(line, '\n')
+
+	r.Lock()
+	defer r.Unlock()
+	if r.file == nil {
+		return
+	}
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(line)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			log.Printf("[ERROR] messageRecorder - %s, recording stopped\n", err.Error())
+			r.file = nil
+			return
+		}
+	}
+	n, err := r.file.Write(line)
+	r.size += int64(n)
+	if err != nil {
+		log.Printf("[ERROR] messageRecorder - Failed to write recording: %s\n", err.Error())
+	}
+}
+
+// recordMessage adds a message to the recording when the adapter is started with -recordFile
+func recordMessage(msg *bridgeMessage) {
+	if recorder != nil {
+		recorder.record(msg)
+	}
+}
+
+func initRecorder() {
+	if recordFile == "" {
+		return
+	}
+	var err error
+	if recorder, err = openRecorder(recordFile, int64(recordMaxSizeMB)<<20, recordMaxFiles); err != nil {
+		log.Fatalf("[FATAL] initRecorder - %s", err.Error())
+	}
+	log.Printf("[INFO] initRecorder - Recording bridged messages to %s\n", recordFile)
+}
+
+// runReplay implements the replay subcommand, which republishes a recording to ClearBlade or the external broker.
+// Outgoing messages were published on ClearBlade and incoming messages on the external broker, so by default
+// only the messages that originated on the target side are replayed
+func runReplay(args []string) int {
+	var file, target, direction string
+	var speed float64
+	flag.StringVar(&file, "file", "", "Recording to replay (required)")
+	flag.StringVar(&target, "target", connectionClearBlade, "Side to publish the recording to, 'clearblade' or 'external' (optional)")
+	flag.StringVar(&direction, "direction", "", "Only replay messages recorded in this direction, 'outgoing' or 'incoming'. Defaults to outgoing for clearblade and incoming for external (optional)")
+	flag.Float64Var(&speed, "speed", 1, "Replay speed relative to the original timing, e.g. 2 for twice as fast, 0 to publish as fast as possible (optional)")
+	flag.Usage = func() {
+		log.Printf("Usage: mqttBridgeAdapter replay -file=<RECORDING> -target=<clearblade|external> [options]\n\n")
+		flag.PrintDefaults()
+	}
+	flag.CommandLine.Parse(args)
+
+	if file == "" {
+		log.Println("ERROR - Missing required flags")
+		flag.Usage()
+		return 1
+	}
+	if direction == "" {
+		direction = directionOutgoing
+		if target == connectionExternal {
+			direction = directionIncoming
+		}
+	}
+
+	recording, err := os.Open(file)
+	if err != nil {
+		log.Printf("ERROR - Unable to open recording: %s\n", err.Error())
+		return 1
+	}
+	defer recording.Close()
+
+	checkRequiredFlags()
+	client, err := replayClient(target)
+	if err != nil {
+		log.Printf("ERROR - %s\n", err.Error())
+		return 1
+	}
+	defer client.Disconnect(250)
+
+	var start time.Time
+	var first time.Time
+	published := 0
+	scanner := bufio.NewScanner(recording)
+	scanner.Buffer(make([]byte, 64*1024), maxIngestBodyBytes*2)
+	for scanner.Scan() {
+		var msg recordedMessage
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			log.Printf("ERROR - Skipping invalid recording line: %s\n", err.Error())
+			continue
+		}
+		if msg.Direction != direction {
+			continue
+		}
+
+		if start.IsZero() {
+			start, first = time.Now(), msg.Timestamp
+		} else if speed > 0 {
+			time.Sleep(time.Until(start.Add(time.Duration(float64(msg.Timestamp.Sub(first)) / speed))))
+		}
+
+		if token := client.Publish(msg.Topic, msg.QoS, msg.Retain, msg.Payload); token.Wait() && token.Error() != nil {
+			log.Printf("ERROR - Failed to publish to %s: %s\n", msg.Topic, token.Error())
+			return 1
+		}
+		published++
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("ERROR - Unable to read recording: %s\n", err.Error())
+		return 1
+	}
+	log.Printf("Replayed %d %s messages to %s\n", published, direction, target)
+	return 0
+}
+
+// replayClient connects to the side of the bridge a recording is replayed to
+func replayClient(target string) (mqtt.Client, error) {
+	deviceClient := newCbClient(parentCredentials())
+	if err := authenticateCbClient(deviceClient); err != nil {
+		return nil, fmt.Errorf("Unable to authenticate with ClearBlade: %s", err.Error())
+	}
+	setCbClient(deviceClient)
+
+	opts := mqtt.NewClientOptions()
+	switch target {
+	case connectionClearBlade:
+		opts.AddBroker(messagingURL)
+		opts.SetUsername(cbClientToken(deviceClient))
+		opts.SetPassword(sysKey)
+	case connectionExternal:
+		newConfig, err := loadAdapterConfig(deviceClient)
+		if err != nil {
+			return nil, err
+		}
+		if newConfig.BrokerConfig.Mode != modeMQTT {
+			return nil, fmt.Errorf("Recordings can only be replayed to an external MQTT broker, mode is %s", newConfig.BrokerConfig.Mode)
+		}
+		setConfig(newConfig)
+		opts.AddBroker(newConfig.BrokerConfig.MessagingURL)
+		username, password := newConfig.BrokerConfig.Username, newConfig.BrokerConfig.Password
+		if newConfig.BrokerConfig.IsCbBroker {
+			if err := initOtherCbClient(); err != nil {
+				return nil, err
+			}
+			username, password = otherCbCredentials()
+		}
+		if username != "" {
+			opts.SetUsername(username)
+		}
+		if password != "" {
+			opts.SetPassword(password)
+		}
+	default:
+		return nil, fmt.Errorf("Unknown replay target: %s", target)
+	}
+	opts.SetClientID(defaultClientID("-replay"))
+	opts.SetConnectTimeout(8 * time.Second)
+
+	client := mqtt.NewClient(opts)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		return nil, fmt.Errorf("Unable to connect to %s: %s", target, token.Error())
+	}
+	return client, nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/json"
+	"text/template"
+
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// routeConfig applies options to the messages on the topics matching a topic filter. Topics are relative to
+// {topic_root}/outgoing or {topic_root}/incoming, which is the topic used on the external side
+type routeConfig struct {
+	Topic             string          `json:"topic"`
+	Direction         string          `json:"direction"`         // outgoing, incoming, or both if empty
+	Compression       string          `json:"compression"`       // gzip, zstd or snappy
+	CompressionMarker string          `json:"compressionMarker"` // suffix (default) or envelope
+	Schema            json.RawMessage `json:"schema"`            // JSON Schema the payload must match
+	Codec             string          `json:"codec"`             // cbor or msgpack, the format used on the external side
+	Template          string          `json:"template"`          // text/template producing the forwarded payload
+	Dedup             *dedupConfig    `json:"dedup"`             // drop incoming duplicates
+
+	// set by parseAdapterConfig
+	compiledSchema   *gojsonschema.Schema
+	compiledTemplate *template.Template
+	dedupWindow      *dedupWindow
+}
+
+// findRoute returns the first route matching a message's direction and topic, or nil if there isn't one
+func findRoute(direction, topic string) *routeConfig {
+	routes := currentConfig().BrokerConfig.Routes
+	for i, route := range routes {
+		if route.Direction != "" && route.Direction != direction {
+			continue
+		}
+		if topicMatchesFilter(route.Topic, topic) {
+			return &routes[i]
+		}
+	}
+	return nil
+}
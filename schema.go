@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// maxSchemaErrors limits how many validation errors are included in the dead letter reason
+const maxSchemaErrors = 5
+
+// compileSchema compiles a route's JSON Schema, returning nil if the route doesn't have one
+func compileSchema(schema json.RawMessage) (*gojsonschema.Schema, error) {
+	if len(schema) == 0 || string(schema) == "null" {
+		return nil, nil
+	}
+	return gojsonschema.NewSchema(gojsonschema.NewBytesLoader(schema))
+}
+
+// validatePayload rejects messages on routes with a schema whose payload is not JSON matching the schema
+func validatePayload(msg *bridgeMessage) error {
+	route := findRoute(msg.Direction, msg.Topic)
+	if route == nil || route.compiledSchema == nil {
+		return nil
+	}
+
+	result, err := route.compiledSchema.Validate(gojsonschema.NewBytesLoader(msg.Payload))
+	if err != nil {
+		incrementStat(statSchemaRejected)
+		return fmt.Errorf("payload is not valid JSON: %s", err.Error())
+	}
+	if result.Valid() {
+		return nil
+	}
+
+	incrementStat(statSchemaRejected)
+	var problems []string
+	for i, problem := range result.Errors() {
+		if i == maxSchemaErrors {
+			problems = append(problems, fmt.Sprintf("and %d more", len(result.Errors())-maxSchemaErrors))
+			break
+		}
+		problems = append(problems, problem.String())
+	}
+	return fmt.Errorf("payload does not match the schema for route %s: %s", route.Topic, strings.Join(problems, "; "))
+}
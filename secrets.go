@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const (
+	secretEnvPrefix       = "env:"  // env:NAME reads the secret from an environment variable
+	secretFilePrefix      = "file:" // file:/path reads the secret from a file
+	secretEncryptedPrefix = "enc:"  // enc:<base64> is decrypted with the key in secretKeyFile
+	redacted              = "[REDACTED]"
+)
+
+var secretKeyFile string
+
+// resolveSecret returns the value a secret reference points to, values without a known prefix are returned as is
+func resolveSecret(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, secretEnvPrefix):
+		name := strings.TrimPrefix(value, secretEnvPrefix)
+		secret, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return secret, nil
+	case strings.HasPrefix(value, secretFilePrefix):
+		path := strings.TrimPrefix(value, secretFilePrefix)
+		secret, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("unable to read secret file: %s", err.Error())
+		}
+		return strings.TrimRight(string(secret), "\r\n"), nil
+	case strings.HasPrefix(value, secretEncryptedPrefix):
+		return decryptSecret(strings.TrimPrefix(value, secretEncryptedPrefix))
+	}
+	return value, nil
+}
+
+// resolveSecrets replaces every secret reference in the adapter settings with its value
+func resolveSecrets(b *mqttBroker) error {
+	fields := map[string]*string{
+		"username":     &b.Username,
+		"password":     &b.Password,
+		"systemSecret": &b.SystemSecret,
+		"activeKey":    &b.ActiveKey,
+		"token":        &b.Token,
+	}
+	if b.HTTP != nil {
+		fields["http.secret"] = &b.HTTP.Secret
+		for i := range b.HTTP.Webhooks {
+			for key, value := range b.HTTP.Webhooks[i].Headers {
+				secret, err := resolveSecret(value)
+				if err != nil {
+					return fmt.Errorf("Failed to resolve webhook header %s: %s", key, err.Error())
+				}
+				b.HTTP.Webhooks[i].Headers[key] = secret
+			}
+		}
+	}
+
+	for name, field := range fields {
+		secret, err := resolveSecret(*field)
+		if err != nil {
+			return fmt.Errorf("Failed to resolve %s: %s", name, err.Error())
+		}
+		*field = secret
+	}
+	return nil
+}
+
+// redactedConfig returns a copy of the config that is safe to log
+func redactedConfig(c adapterConfig) adapterConfig {
+	redact := func(value string) string {
+		if value == "" {
+			return value
+		}
+		return redacted
+	}
+
+	b := &c.BrokerConfig
+	b.Username = redact(b.Username)
+	b.Password = redact(b.Password)
+	b.SystemSecret = redact(b.SystemSecret)
+	b.ActiveKey = redact(b.ActiveKey)
+	b.Token = redact(b.Token)
+	if b.HTTP != nil {
+		httpConf := *b.HTTP
+		httpConf.Secret = redact(httpConf.Secret)
+		httpConf.Webhooks = make([]webhookRoute, len(b.HTTP.Webhooks))
+		for i, webhook := range b.HTTP.Webhooks {
+			headers := make(map[string]string, len(webhook.Headers))
+			for key, value := range webhook.Headers {
+				headers[key] = redact(value)
+			}
+			webhook.Headers = headers
+			httpConf.Webhooks[i] = webhook
+		}
+		b.HTTP = &httpConf
+	}
+	return c
+}
+
+func loadSecretKey() ([]byte, error) {
+	if secretKeyFile == "" {
+		return nil, fmt.Errorf("no secretKeyFile provided to decrypt secrets with")
+	}
+	encoded, err := ioutil.ReadFile(secretKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read secret key file: %s", err.Error())
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil {
+		return nil, fmt.Errorf("secret key file must contain a base64 encoded key: %s", err.Error())
+	}
+	return key, nil
+}
+
+func secretCipher() (cipher.AEAD, error) {
+	key, err := loadSecretKey()
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// decryptSecret decrypts a base64 encoded AES-GCM nonce and ciphertext
+func decryptSecret(encoded string) (string, error) {
+	gcm, err := secretCipher()
+	if err != nil {
+		return "", err
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("encrypted secret is not valid base64: %s", err.Error())
+	}
+	if len(data) < gcm.NonceSize() {
+		return "", fmt.Errorf("encrypted secret is too short")
+	}
+	plaintext, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("unable to decrypt secret: %s", err.Error())
+	}
+	return string(plaintext), nil
+}
+
+func encryptSecret(secret string) (string, error) {
+	gcm, err := secretCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	return secretEncryptedPrefix + base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte(secret), nil)), nil
+}
+
+// runEncrypt implements the encrypt subcommand, which reads a secret from stdin and prints an enc: value
+// that can be used in adapter_settings
+func runEncrypt(args []string) int {
+	flags := flag.NewFlagSet("encrypt", flag.ExitOnError)
+	flags.StringVar(&secretKeyFile, "secretKeyFile", "", "File containing the base64 encoded AES key used to encrypt the secret (required)")
+	flags.Parse(args)
+
+	secret, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		fmt.Fprintf(os.Stderr, "ERROR - Unable to read secret from stdin: %s\n", err.Error())
+		return 1
+	}
+
+	encrypted, err := encryptSecret(strings.TrimRight(secret, "\r\n"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR - Unable to encrypt secret: %s\n", err.Error())
+		return 1
+	}
+	fmt.Println(encrypted)
+	return 0
+}
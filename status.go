@@ -0,0 +1,318 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	mqtt "github.com/clearblade/paho.mqtt.golang"
+)
+
+const (
+	statOutgoingForwarded   = "outgoingForwarded"
+	statOutgoingFailed      = "outgoingFailed"
+	statOutgoingPaused      = "outgoingPaused"
+	statOutgoingDenied      = "outgoingDenied"
+	statIncomingForwarded   = "incomingForwarded"
+	statIncomingFailed      = "incomingFailed"
+	statIncomingPaused      = "incomingPaused"
+	statEchoSuppressed      = "echoSuppressed"
+	statDeadLettered        = "deadLettered"
+	statOversizedPayloads   = "oversizedPayloads"
+	statCompressionBytesIn  = "compressionBytesIn"
+	statCompressionBytesOut = "compressionBytesOut"
+	statSchemaRejected      = "schemaRejected"
+	statDuplicatesDropped   = "duplicatesDropped"
+	statCbReconnects        = "cbReconnects"
+	statExternalReconnects  = "externalReconnects"
+
+	connectionClearBlade = "clearblade"
+	connectionExternal   = "external"
+
+	defaultStatusInterval = 60 * time.Second
+)
+
+var (
+	errForwardingPaused = errors.New("forwarding is paused")
+	errTopicDenied      = errors.New("topic is not allowed by the outgoing filter")
+
+	stats = bridgeStats{
+		counters:    make(map[string]uint64),
+		connections: make(map[string]*connectionState),
+		paused:      make(map[string]bool),
+	}
+	statusChanged = make(chan struct{}, 1)
+)
+
+// publishError is a failure publishing a message to ClearBlade, which may succeed if the message is forwarded
+// again. Any other error forwarding a message would happen again, so the message is dead lettered instead
+type publishError struct {
+	err error
+}
+
+func (e *publishError) Error() string {
+	return e.err.Error()
+}
+
+func isPublishError(err error) bool {
+	_, ok := err.(*publishError)
+	return ok
+}
+
+// bridgeStats holds the counters and connection states reported on {topic_root}/status
+type bridgeStats struct {
+	sync.Mutex
+	counters    map[string]uint64
+	connections map[string]*connectionState
+	paused      map[string]bool
+}
+
+type connectionState struct {
+	Connected     bool      `json:"connected"`
+	LastConnected time.Time `json:"lastConnected,omitempty"`
+}
+
+type bridgeStatus struct {
+	State            string                      `json:"state"`
+	BuildID          string                      `json:"buildId"`
+	ConfigVersion    string                      `json:"configVersion"`
+	Mode             string                      `json:"mode"`
+	Connections      map[string]*connectionState `json:"connections"`
+	Paused           map[string]bool             `json:"paused"`
+	Counters         map[string]uint64           `json:"counters"`
+	OutgoingQueues   []int                       `json:"outgoingQueues,omitempty"`   // messages waiting in each outgoing worker's queue
+	CompressionRatio float64                     `json:"compressionRatio,omitempty"` // compressed size as a fraction of the original size
+	Timestamp        time.Time                   `json:"timestamp"`
+}
+
+// controlCommand is accepted on {topic_root}/control
+type controlCommand struct {
+	Command   string `json:"command"`
+	Direction string `json:"direction"` // used by pause and resume, both directions if empty
+	Level     string `json:"level"`     // used by set-log-level
+}
+
+func incrementStat(name string) {
+	addStat(name, 1)
+}
+
+func addStat(name string, value uint64) {
+	stats.Lock()
+	stats.counters[name] += value
+	stats.Unlock()
+}
+
+func setConnected(connection string, connected bool) {
+	stats.Lock()
+	state, ok := stats.connections[connection]
+	if !ok {
+		state = &connectionState{}
+		stats.connections[connection] = state
+	}
+	state.Connected = connected
+	if connected {
+		state.LastConnected = time.Now().UTC()
+	}
+	stats.Unlock()
+	notifyStatusChanged()
+	recordConnectionEvent(connection, connected)
+}
+
+func setPaused(direction string, paused bool) {
+	stats.Lock()
+	if direction == "" || direction == directionOutgoing {
+		stats.paused[directionOutgoing] = paused
+	}
+	if direction == "" || direction == directionIncoming {
+		stats.paused[directionIncoming] = paused
+	}
+	stats.Unlock()
+	notifyStatusChanged()
+}
+
+func isPaused(direction string) bool {
+	stats.Lock()
+	defer stats.Unlock()
+	return stats.paused[direction]
+}
+
+func currentStatus() bridgeStatus {
+	stats.Lock()
+	defer stats.Unlock()
+
+	current := currentConfig()
+	status := bridgeStatus{
+		State:         "online",
+		BuildID:       BuildId,
+		ConfigVersion: current.Version,
+		Mode:          current.BrokerConfig.Mode,
+		Connections:   make(map[string]*connectionState),
+		Paused:        make(map[string]bool),
+		Counters:      make(map[string]uint64),
+		Timestamp:     time.Now().UTC(),
+	}
+	for name, state := range stats.connections {
+		stateCopy := *state
+		status.Connections[name] = &stateCopy
+	}
+	for direction, paused := range stats.paused {
+		status.Paused[direction] = paused
+	}
+	for name, value := range stats.counters {
+		status.Counters[name] = value
+	}
+	status.CompressionRatio = compressionRatio(status.Counters[statCompressionBytesIn], status.Counters[statCompressionBytesOut])
+	if outgoingWorkers != nil {
+		status.OutgoingQueues = outgoingWorkers.queueDepths()
+	}
+	return status
+}
+
+func notifyStatusChanged() {
+	select {
+	case statusChanged <- struct{}{}:
+	default:
+	}
+}
+
+func statusTopic() string {
+	return currentConfig().TopicRoot + "/status"
+}
+
+func controlTopic() string {
+	return currentConfig().TopicRoot + "/control"
+}
+
+// offlineStatus is used as the last will on the ClearBlade connection
+func offlineStatus() []byte {
+	payload, _ := json.Marshal(map[string]string{"state": "offline", "buildId": BuildId})
+	return payload
+}
+
+func configVersion(topicRoot, adapterSettings string) string {
+	hash := sha256.Sum256([]byte(topicRoot + "\n" + adapterSettings))
+	return hex.EncodeToString(hash[:6])
+}
+
+// statusPublisher publishes the retained status on the configured interval and whenever the status changes
+func statusPublisher() {
+	for {
+		interval := defaultStatusInterval
+		if seconds := currentConfig().BrokerConfig.StatusIntervalSeconds; seconds > 0 {
+			interval = time.Duration(seconds) * time.Second
+		}
+		select {
+		case <-time.After(interval):
+		case <-statusChanged:
+		}
+		publishStatus()
+	}
+}
+
+func publishStatus() {
+	if cbMqttClient == nil || !cbMqttClient.IsConnected() {
+		return
+	}
+	payload, err := json.Marshal(currentStatus())
+	if err != nil {
+		log.Printf("[ERROR] publishStatus - Failed to create status: %s\n", err.Error())
+		return
+	}
+	if token := cbMqttClient.Publish(statusTopic(), qos(), true, payload); token.Wait() && token.Error() != nil {
+		log.Printf("[ERROR] publishStatus - Failed to publish status: %s\n", token.Error())
+	}
+}
+
+func controlMessageHandler(client mqtt.Client, msg mqtt.Message) {
+	var command controlCommand
+	if err := json.Unmarshal(msg.Payload(), &command); err != nil {
+		log.Printf("[ERROR] controlMessageHandler - Failed to parse control message: %s\n", err.Error())
+		return
+	}
+	log.Printf("[INFO] controlMessageHandler - Received command: %+v\n", command)
+
+	switch command.Command {
+	case "reconnect-external":
+		go reconnectExternal()
+	case "reload-config":
+		go reloadConfig()
+	case "pause":
+		setPaused(command.Direction, true)
+	case "resume":
+		setPaused(command.Direction, false)
+	case "set-log-level":
+		if err := setLogLevel(command.Level); err != nil {
+			log.Printf("[ERROR] controlMessageHandler - %s\n", err.Error())
+		}
+	case "dump-stats":
+		status, _ := json.Marshal(currentStatus())
+		log.Printf("[INFO] controlMessageHandler - Stats: %s\n", string(status))
+		if dryRun {
+			logRoutingSummary()
+		}
+		notifyStatusChanged()
+	default:
+		log.Printf("[ERROR] controlMessageHandler - Unknown command: %s\n", command.Command)
+	}
+}
+
+// reloadConfig fetches the adapter config again and reconnects the external side with it
+func reloadConfig() {
+	log.Println("[INFO] reloadConfig - Reloading adapter config")
+	newConfig, err := loadAdapterConfig(currentCbClient())
+	if err != nil {
+		log.Printf("[ERROR] reloadConfig - Keeping current config: %s\n", err.Error())
+		return
+	}
+	if err := checkReloadable(newConfig); err != nil {
+		log.Printf("[ERROR] reloadConfig - Keeping current config: %s\n", err.Error())
+		return
+	}
+	setConfig(newConfig)
+	log.Printf("[DEBUG] reloadConfig - Using adapter settings:\n%+v\n", redactedConfig(newConfig))
+
+	reconnectExternal()
+}
+
+// checkReloadable returns an error if newConfig changes settings that only take effect when the adapter
+// starts, i.e. the topic root the ClearBlade side is subscribed under and the mode of the external side
+func checkReloadable(newConfig adapterConfig) error {
+	current := currentConfig()
+	if newConfig.TopicRoot != current.TopicRoot {
+		return fmt.Errorf("topic_root changed from %s to %s, restart the adapter to use it", current.TopicRoot, newConfig.TopicRoot)
+	}
+	if newConfig.BrokerConfig.Mode != current.BrokerConfig.Mode {
+		return fmt.Errorf("mode changed from %s to %s, restart the adapter to use it", current.BrokerConfig.Mode, newConfig.BrokerConfig.Mode)
+	}
+	return nil
+}
+
+// reconnectExternal drops the current external connection and connects again using the current config
+func reconnectExternal() {
+	log.Println("[INFO] reconnectExternal - Reconnecting external side")
+	var err error
+	switch currentConfig().BrokerConfig.Mode {
+	case modeKafka:
+		for err = initKafka(); err != nil; {
+			log.Println("[ERROR] Failed to initialize Kafka client, trying again in 1 second")
+			time.Sleep(time.Duration(time.Second * 1))
+			err = initKafka()
+		}
+	case modeHTTP:
+		err = initHTTP()
+	default:
+		setConnected(connectionExternal, false)
+		if !otherConnection.restart(time.Second, 250) {
+			log.Println("[INFO] reconnectExternal - External side is already reconnecting")
+			return
+		}
+	}
+	if err == nil {
+		incrementStat(statExternalReconnects)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTelemetryInterval   = 300 * time.Second
+	defaultTelemetryBufferSize = 1000
+)
+
+var telemetryBuffer = telemetryRows{}
+
+type telemetryConfig struct {
+	CollectionID    string `json:"collectionID"`
+	IntervalSeconds int    `json:"intervalSeconds"`
+	BufferSize      int    `json:"bufferSize"`
+}
+
+// telemetryRows buffers rows until they have been written to the telemetry collection
+type telemetryRows struct {
+	sync.Mutex
+	rows []map[string]interface{}
+}
+
+func (t *telemetryRows) add(row map[string]interface{}) {
+	bufferSize := defaultTelemetryBufferSize
+	if telemetry := currentConfig().BrokerConfig.Telemetry; telemetry != nil && telemetry.BufferSize > 0 {
+		bufferSize = telemetry.BufferSize
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	t.rows = append(t.rows, row)
+	if dropped := len(t.rows) - bufferSize; dropped > 0 {
+		log.Printf("[WARN] telemetryRows - Buffer full, dropping %d oldest rows\n", dropped)
+		t.rows = t.rows[dropped:]
+	}
+}
+
+// flush writes all buffered rows to the collection, rows are kept if the write fails
+func (t *telemetryRows) flush(collectionID string) {
+	t.Lock()
+	rows := t.rows
+	t.rows = nil
+	t.Unlock()
+
+	if len(rows) == 0 {
+		return
+	}
+
+	if _, err := currentCbClient().CreateData(collectionID, rows); err != nil {
+		log.Printf("[ERROR] telemetryRows - Failed to write %d rows to telemetry collection, will retry: %s\n", len(rows), err.Error())
+		// the device token may have expired, make sure the retry uses a fresh one
+		if err := refreshCbToken(); err != nil {
+			log.Printf("[ERROR] telemetryRows - Failed to refresh ClearBlade token: %s\n", err.Error())
+		}
+		t.Lock()
+		t.rows = append(rows, t.rows...)
+		t.Unlock()
+		return
+	}
+	log.Printf("[DEBUG] telemetryRows - Wrote %d rows to telemetry collection\n", len(rows))
+}
+
+func telemetryEnabled() bool {
+	telemetry := currentConfig().BrokerConfig.Telemetry
+	return telemetry != nil && telemetry.CollectionID != ""
+}
+
+// recordConnectionEvent buffers a connection state change for the telemetry collection
+func recordConnectionEvent(connection string, connected bool) {
+	if !telemetryEnabled() {
+		return
+	}
+	event := connection + "_disconnected"
+	if connected {
+		event = connection + "_connected"
+	}
+	telemetryBuffer.add(map[string]interface{}{
+		"adapter_name": deviceName,
+		"type":         "event",
+		"event":        event,
+		"timestamp":    time.Now().UTC().Format(time.RFC3339),
+	})
+}
+
+// telemetryWriter periodically buffers a rollup of the counters since the last rollup, and writes
+// all buffered rows to the telemetry collection
+func telemetryWriter() {
+	lastCounters := map[string]uint64{}
+	for {
+		interval := defaultTelemetryInterval
+		if telemetry := currentConfig().BrokerConfig.Telemetry; telemetry != nil && telemetry.IntervalSeconds > 0 {
+			interval = time.Duration(telemetry.IntervalSeconds) * time.Second
+		}
+		time.Sleep(interval)
+
+		status := currentStatus()
+		delta := func(names ...string) uint64 {
+			var total uint64
+			for _, name := range names {
+				total += status.Counters[name] - lastCounters[name]
+			}
+			return total
+		}
+		rollup := map[string]interface{}{
+			"adapter_name":      deviceName,
+			"type":              "rollup",
+			"timestamp":         status.Timestamp.Format(time.RFC3339),
+			"messages_outgoing": delta(statOutgoingForwarded),
+			"messages_incoming": delta(statIncomingForwarded),
+			"errors":            delta(statOutgoingFailed, statIncomingFailed),
+			"dead_letters":      delta(statDeadLettered),
+			"reconnects":        delta(statCbReconnects, statExternalReconnects),
+		}
+		if bytesIn := delta(statCompressionBytesIn); bytesIn > 0 {
+			rollup["compression_ratio"] = compressionRatio(bytesIn, delta(statCompressionBytesOut))
+		}
+		if state, ok := status.Connections[connectionClearBlade]; ok && !state.LastConnected.IsZero() {
+			rollup["cb_last_connected"] = state.LastConnected.Format(time.RFC3339)
+		}
+		if state, ok := status.Connections[connectionExternal]; ok && !state.LastConnected.IsZero() {
+			rollup["external_last_connected"] = state.LastConnected.Format(time.RFC3339)
+		}
+		lastCounters = status.Counters
+
+		telemetry := currentConfig().BrokerConfig.Telemetry
+		if telemetry == nil || telemetry.CollectionID == "" {
+			continue
+		}
+		telemetryBuffer.add(rollup)
+		telemetryBuffer.flush(telemetry.CollectionID)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// topicMatchesFilter reports whether topic matches the MQTT topic filter, supporting the + and # wildcards
+func topicMatchesFilter(filter, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
+
+// topicLevel returns the 1 based level of topic, or an empty string if the topic does not have that many levels
+func topicLevel(topic string, level int) string {
+	levels := strings.Split(topic, "/")
+	if level < 1 || level > len(levels) {
+		return ""
+	}
+	return levels[level-1]
+}
+
+// outgoingFilterConfig limits the topics messages from ClearBlade may be forwarded to. Filters match the topic
+// relative to {topic_root}/outgoing, a topic must match an allow filter (if there are any) and no deny filter
+type outgoingFilterConfig struct {
+	Allow      []string `json:"allow"`
+	Deny       []string `json:"deny"`
+	DeadLetter bool     `json:"deadLetter"` // send denied messages to the dead letter topic
+}
+
+// outgoingTopicAllowed reports whether a message may be forwarded to topic
+func outgoingTopicAllowed(topic string) bool {
+	filter := currentConfig().BrokerConfig.OutgoingFilter
+	if filter == nil {
+		return true
+	}
+	for _, deny := range filter.Deny {
+		if topicMatchesFilter(deny, topic) {
+			return false
+		}
+	}
+	if len(filter.Allow) == 0 {
+		return true
+	}
+	for _, allow := range filter.Allow {
+		// as on an MQTT broker, wildcards at the first level don't match topics starting with $
+		if strings.HasPrefix(topic, "$") && (strings.HasPrefix(allow, "+") || strings.HasPrefix(allow, "#")) {
+			continue
+		}
+		if topicMatchesFilter(allow, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+func deadLetterDenied() bool {
+	filter := currentConfig().BrokerConfig.OutgoingFilter
+	return filter != nil && filter.DeadLetter
+}
+
+// checkTopicName returns an error if topic can't be published to, i.e. it is empty or contains wildcards or
+// null characters, which would make the broker drop the connection
+func checkTopicName(topic string) error {
+	if topic == "" {
+		return fmt.Errorf("topic must not be empty")
+	}
+	if strings.ContainsAny(topic, "+#\x00") {
+		return fmt.Errorf("%s: topic must not contain wildcards or null characters", topic)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const traceparentKey = "traceparent"
+
+var (
+	otlpEndpoint      string
+	traceContextField string
+	tracingEnabled    bool
+	tracer            = otel.Tracer("mqtt-bridge-adapter") // a no-op tracer until initTracing sets a provider
+	tracePropagator   = propagation.TraceContext{}
+)
+
+// initTracing exports spans to the OTLP/HTTP collector at otlpEndpoint, tracing is disabled if no endpoint is set
+func initTracing() {
+	if otlpEndpoint == "" {
+		return
+	}
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpoint(otlpEndpoint), otlptracehttp.WithInsecure())
+	if err != nil {
+		log.Printf("[ERROR] initTracing - Unable to create OTLP exporter, tracing is disabled: %s\n", err.Error())
+		return
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", "mqtt-bridge-adapter"),
+			attribute.String("service.version", BuildId),
+			attribute.String("adapter.name", deviceName),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(tracePropagator)
+	tracer = provider.Tracer("mqtt-bridge-adapter")
+	tracingEnabled = true
+	log.Printf("[INFO] initTracing - Exporting traces to %s\n", otlpEndpoint)
+}
+
+// startReceiveSpan starts the span covering a message's trip across the bridge, continuing the trace from the
+// trace context field in the payload if there is one
+func startReceiveSpan(msg *bridgeMessage) trace.Span {
+	ctx := context.Background()
+	if tracingEnabled {
+		if traceparent, ok := payloadTraceparent(msg.Payload); ok {
+			ctx = tracePropagator.Extract(ctx, propagation.MapCarrier{traceparentKey: traceparent})
+		}
+	}
+	ctx, span := tracer.Start(ctx, msg.Direction+" receive",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("messaging.source.name", msg.SourceTopic),
+			attribute.String("messaging.message.id", msg.ID),
+			attribute.Int("messaging.message.body.size", len(msg.Payload)),
+			attribute.String("bridge.direction", msg.Direction),
+		))
+	msg.Context = ctx
+	return span
+}
+
+// endSpan records err on the span, if there was one, and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil && err != errForwardingPaused && err != errDuplicateMessage {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func startMessageSpan(msg *bridgeMessage, name string, kind trace.SpanKind) trace.Span {
+	ctx := msg.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	_, span := tracer.Start(ctx, msg.Direction+" "+name, trace.WithSpanKind(kind))
+	return span
+}
+
+// payloadTraceparent returns the trace context field of a JSON object payload
+func payloadTraceparent(payload []byte) (string, bool) {
+	var envelope map[string]interface{}
+	if err := json.Unmarshal(payload, &envelope); err != nil {
+		return "", false
+	}
+	traceparent, ok := envelope[traceContextField].(string)
+	return traceparent, ok
+}
+
+// injectTraceContext replaces the trace context field of a JSON object payload with the message's trace
+// context, so the next hop continues this trace. Payloads without the field are left unchanged
+func injectTraceContext(msg *bridgeMessage) {
+	if !tracingEnabled || msg.Context == nil {
+		return
+	}
+	// the other fields are kept as raw JSON, so e.g. large integers aren't rounded to floats
+	var envelope map[string]json.RawMessage
+	if err := json.Unmarshal(msg.Payload, &envelope); err != nil {
+		return
+	}
+	if _, ok := envelope[traceContextField]; !ok {
+		return
+	}
+
+	carrier := propagation.MapCarrier{}
+	tracePropagator.Inject(msg.Context, carrier)
+	if carrier[traceparentKey] == "" {
+		return
+	}
+	traceparent, err := json.Marshal(carrier[traceparentKey])
+	if err != nil {
+		return
+	}
+	envelope[traceContextField] = traceparent
+	payload, err := json.Marshal(envelope)
+	if err != nil {
+		return
+	}
+	msg.Payload = payload
+	msg.Transforms = append(msg.Transforms, "traceContext")
+}
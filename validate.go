@@ -0,0 +1,443 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+var (
+	messagingURLSchemes = []string{"tcp", "ssl", "tls", "ws", "wss", "mqtt", "mqtts"}
+	platformURLSchemes  = []string{"http", "https"}
+)
+
+// parseAdapterConfig parses and validates an adapter config collection row, reporting every problem found
+func parseAdapterConfig(configData map[string]interface{}) (adapterConfig, []error) {
+	var problems []error
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Errorf(format, args...))
+	}
+
+	newConfig := adapterConfig{TopicRoot: "mqtt-bridge-adapter"}
+
+	switch topicRoot := configData["topic_root"].(type) {
+	case nil:
+	case string:
+		if topicRoot != "" {
+			newConfig.TopicRoot = topicRoot
+		}
+	default:
+		problem("topic_root must be a string, got %T", topicRoot)
+	}
+	if strings.ContainsAny(newConfig.TopicRoot, "+#") {
+		problem("topic_root must not contain wildcards: %s", newConfig.TopicRoot)
+	}
+
+	// adapter_settings is normally a JSON string, but accept an object for json columns
+	var settings []byte
+	switch adapterSettings := configData["adapter_settings"].(type) {
+	case nil:
+		problem("No adapter settings provided, this is required")
+		return newConfig, problems
+	case string:
+		settings = []byte(adapterSettings)
+	case map[string]interface{}:
+		settings, _ = json.Marshal(adapterSettings)
+	default:
+		problem("adapter_settings must be a JSON string, got %T", adapterSettings)
+		return newConfig, problems
+	}
+
+	var raw map[string]interface{}
+	if err := json.Unmarshal(settings, &raw); err != nil {
+		problem("Failed to parse adapter_settings: %s", err.Error())
+		return newConfig, problems
+	}
+	problems = append(problems, unknownFields(raw, reflect.TypeOf(mqttBroker{}), "adapter_settings")...)
+
+	var bC mqttBroker
+	if err := json.Unmarshal(settings, &bC); err != nil {
+		problem("Failed to parse adapter_settings: %s", err.Error())
+		return newConfig, problems
+	}
+
+	if err := resolveSecrets(&bC); err != nil {
+		problem("%s", err.Error())
+	}
+
+	switch bC.Mode {
+	case "", modeMQTT:
+		bC.Mode = modeMQTT
+		if bC.MessagingURL == "" {
+			problem("No messaging URL defined for broker config adapter_settings")
+		} else if err := checkURL(bC.MessagingURL, messagingURLSchemes); err != nil {
+			problem("Invalid messagingURL: %s", err.Error())
+		}
+	case modeKafka:
+		if bC.Kafka == nil || len(bC.Kafka.Brokers) == 0 {
+			problem("No kafka brokers defined for broker config adapter_settings")
+		}
+	case modeHTTP:
+		if bC.HTTP == nil || (len(bC.HTTP.Webhooks) == 0 && bC.HTTP.ListenAddress == "") {
+			problem("No webhooks or listenAddress defined for broker config adapter_settings")
+		}
+		if bC.HTTP != nil && bC.HTTP.ListenAddress != "" && bC.HTTP.Secret == "" {
+			problem("http.secret is required when http.listenAddress is set, otherwise anyone can publish to ClearBlade")
+		}
+	default:
+		problem("Unknown mode in adapter_settings: %s, expected one of mqtt, kafka or http", bC.Mode)
+	}
+
+	if bC.IsCbBroker {
+		if bC.PlatformURL == "" {
+			problem("platformURL is required when isCbBroker is true")
+		} else if err := checkURL(bC.PlatformURL, platformURLSchemes); err != nil {
+			problem("Invalid platformURL: %s", err.Error())
+		}
+		if err := otherCredentials(bC).validate(); err != nil {
+			problem("Invalid credentials for isCbBroker: %s", err.Error())
+		}
+	} else if bC.RemoteTopicRoot != "" {
+		problem("remoteTopicRoot is only supported when isCbBroker is true")
+	}
+
+	if bC.QoS < 0 || bC.QoS > 2 {
+		problem("qos must be 0, 1 or 2, got %d", bC.QoS)
+	}
+
+	for i, topic := range bC.Topics {
+		if err := checkTopicFilter(topic); err != nil {
+			problem("Invalid topics[%d]: %s", i, err.Error())
+		}
+	}
+
+	if bC.DeadLetterTopic != "" {
+		if strings.ContainsAny(bC.DeadLetterTopic, "+#") {
+			problem("deadLetterTopic must not contain wildcards: %s", bC.DeadLetterTopic)
+		} else if topicMatchesFilter(newConfig.TopicRoot+"/outgoing/#", bC.DeadLetterTopic) {
+			problem("deadLetterTopic must not be under the outgoing topic")
+		}
+	}
+
+	if bC.Kafka != nil {
+		for _, name := range []string{directionOutgoing, directionIncoming} {
+			routes := bC.Kafka.Outgoing
+			if name == directionIncoming {
+				routes = bC.Kafka.Incoming
+			}
+			for i, route := range routes {
+				if err := checkTopicFilter(route.Topic); err != nil {
+					problem("Invalid kafka.%s[%d].topic: %s", name, i, err.Error())
+				}
+				if route.KafkaTopic == "" {
+					problem("kafka.%s[%d].kafkaTopic is required", name, i)
+				}
+				if route.KeyLevel < 0 {
+					problem("kafka.%s[%d].keyLevel must not be negative", name, i)
+				}
+			}
+		}
+	}
+
+	if bC.HTTP != nil {
+		for i, webhook := range bC.HTTP.Webhooks {
+			if err := checkTopicFilter(webhook.Topic); err != nil {
+				problem("Invalid http.webhooks[%d].topic: %s", i, err.Error())
+			}
+			if _, err := template.New("url").Parse(webhook.URL); webhook.URL == "" || err != nil {
+				problem("Invalid http.webhooks[%d].url: %v", i, err)
+			}
+		}
+	}
+
+	if debugLogging := bC.DebugLogging; debugLogging != nil {
+		if debugLogging.SampleEvery < 0 || debugLogging.MaxPerSecond < 0 || debugLogging.MaxPayloadBytes < 0 {
+			problem("debugLogging.sampleEvery, maxPerSecond and maxPayloadBytes must not be negative")
+		}
+		for i, field := range debugLogging.RedactFields {
+			if field == "" || strings.HasPrefix(field, ".") || strings.HasSuffix(field, ".") {
+				problem("Invalid debugLogging.redactFields[%d]: %q", i, field)
+			}
+		}
+	}
+
+	if filter := bC.OutgoingFilter; filter != nil {
+		for i, allow := range filter.Allow {
+			if err := checkTopicFilter(allow); err != nil {
+				problem("Invalid outgoingFilter.allow[%d]: %s", i, err.Error())
+			}
+		}
+		for i, deny := range filter.Deny {
+			if err := checkTopicFilter(deny); err != nil {
+				problem("Invalid outgoingFilter.deny[%d]: %s", i, err.Error())
+			}
+		}
+		if filter.DeadLetter && bC.DeadLetterTopic == "" {
+			problem("outgoingFilter.deadLetter requires a deadLetterTopic")
+		}
+	}
+
+	if limits := bC.PayloadLimits; limits != nil {
+		for _, direction := range []string{directionOutgoing, directionIncoming} {
+			limit := limits.Outgoing
+			if direction == directionIncoming {
+				limit = limits.Incoming
+			}
+			if limit == nil {
+				continue
+			}
+			switch limit.Action {
+			case "", payloadActionDrop, payloadActionTruncate:
+				if limit.MaxBytes < 0 {
+					problem("payloadLimits.%s.maxBytes must not be negative", direction)
+				}
+			case payloadActionChunk:
+				if limit.MaxBytes < 2*maxChunkHeaderLen {
+					problem("payloadLimits.%s.maxBytes must be at least %d to chunk payloads", direction, 2*maxChunkHeaderLen)
+				}
+			default:
+				problem("Unknown payloadLimits.%s.action: %s, expected one of drop, truncate or chunk", direction, limit.Action)
+			}
+		}
+	}
+
+	for i, route := range bC.Routes {
+		if err := checkTopicFilter(route.Topic); err != nil {
+			problem("Invalid routes[%d].topic: %s", i, err.Error())
+		}
+		if schema, err := compileSchema(route.Schema); err != nil {
+			problem("Invalid routes[%d].schema: %s", i, err.Error())
+		} else {
+			bC.Routes[i].compiledSchema = schema
+		}
+		if tmpl, err := compilePayloadTemplate(route.Template); err != nil {
+			problem("Invalid routes[%d].template: %s", i, err.Error())
+		} else {
+			bC.Routes[i].compiledTemplate = tmpl
+		}
+		if dedup := route.Dedup; dedup != nil {
+			if route.Direction == directionOutgoing {
+				problem("routes[%d].dedup only applies to incoming messages", i)
+			}
+			if dedup.WindowSeconds < 0 || dedup.MaxEntries < 0 {
+				problem("routes[%d].dedup.windowSeconds and maxEntries must not be negative", i)
+			}
+			if window := currentDedupWindow(route); window != nil {
+				bC.Routes[i].dedupWindow = window
+			} else {
+				bC.Routes[i].dedupWindow = newDedupWindow(dedup)
+			}
+		}
+		switch route.Direction {
+		case "", directionOutgoing, directionIncoming:
+		default:
+			problem("Unknown routes[%d].direction: %s, expected outgoing or incoming", i, route.Direction)
+		}
+		if limits := bC.PayloadLimits; (route.Compression != "" || route.Codec != "") && route.Direction != directionIncoming &&
+			limits != nil && limits.Outgoing != nil && limits.Outgoing.Action == payloadActionTruncate {
+			problem("routes[%d] compresses or encodes outgoing payloads, which payloadLimits.outgoing.action truncate would cut into payloads that can't be decoded, use drop or chunk instead", i)
+		}
+		switch route.Compression {
+		case "", compressionGzip, compressionZstd, compressionSnappy:
+		default:
+			problem("Unknown routes[%d].compression: %s, expected one of gzip, zstd or snappy", i, route.Compression)
+		}
+		switch route.Codec {
+		case "", codecCBOR, codecMsgpack:
+		default:
+			problem("Unknown routes[%d].codec: %s, expected cbor or msgpack", i, route.Codec)
+		}
+		switch route.CompressionMarker {
+		case "", compressionMarkerSuffix, compressionMarkerEnvelope:
+		default:
+			problem("Unknown routes[%d].compressionMarker: %s, expected suffix or envelope", i, route.CompressionMarker)
+		}
+	}
+
+	if workerPool := bC.WorkerPool; workerPool != nil {
+		if workerPool.Workers < 0 || workerPool.QueueSize < 0 || workerPool.KeyLevel < 0 {
+			problem("workerPool.workers, queueSize and keyLevel must not be negative")
+		}
+	}
+
+	if bC.Telemetry != nil && bC.Telemetry.CollectionID == "" {
+		problem("telemetry.collectionID is required when telemetry is provided")
+	}
+
+	newConfig.BrokerConfig = bC
+	newConfig.Version = configVersion(newConfig.TopicRoot, string(settings))
+
+	return newConfig, problems
+}
+
+// unknownFieldError is a key in the adapter config that the adapter doesn't use, e.g. one left over from an older
+// version. They are reported as warnings rather than problems, so they don't stop a config from being used
+type unknownFieldError struct {
+	path string
+}
+
+func (e *unknownFieldError) Error() string {
+	return "Unknown field " + e.path
+}
+
+// splitWarnings separates unknown fields from the problems that make a config invalid
+func splitWarnings(problems []error) (errs []error, warnings []error) {
+	for _, problem := range problems {
+		if _, ok := problem.(*unknownFieldError); ok {
+			warnings = append(warnings, problem)
+		} else {
+			errs = append(errs, problem)
+		}
+	}
+	return errs, warnings
+}
+
+// unknownFields reports keys in raw that don't match a json tag of the struct type t, checking nested objects too
+func unknownFields(raw map[string]interface{}, t reflect.Type, path string) []error {
+	fields := map[string]reflect.Type{}
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" {
+			fields[name] = t.Field(i).Type
+		}
+	}
+
+	keys := make([]string, 0, len(raw))
+	for key := range raw {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var problems []error
+	for _, key := range keys {
+		value := raw[key]
+		fieldType, ok := fields[key]
+		if !ok {
+			problems = append(problems, &unknownFieldError{path + "." + key})
+			continue
+		}
+		for fieldType.Kind() == reflect.Ptr {
+			fieldType = fieldType.Elem()
+		}
+		switch nested := value.(type) {
+		case map[string]interface{}:
+			if fieldType.Kind() == reflect.Struct {
+				problems = append(problems, unknownFields(nested, fieldType, path+"."+key)...)
+			}
+		case []interface{}:
+			if fieldType.Kind() == reflect.Slice && fieldType.Elem().Kind() == reflect.Struct {
+				for i, element := range nested {
+					if object, ok := element.(map[string]interface{}); ok {
+						problems = append(problems, unknownFields(object, fieldType.Elem(), fmt.Sprintf("%s.%s[%d]", path, key, i))...)
+					}
+				}
+			}
+		}
+	}
+	return problems
+}
+
+func checkURL(rawURL string, schemes []string) error {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	for _, scheme := range schemes {
+		if parsed.Scheme == scheme {
+			if parsed.Host == "" {
+				return fmt.Errorf("%s has no host", rawURL)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("%s must use one of the schemes %s", rawURL, strings.Join(schemes, ", "))
+}
+
+// checkTopicFilter checks that filter is a valid MQTT topic filter
+func checkTopicFilter(filter string) error {
+	if filter == "" {
+		return fmt.Errorf("topic filter must not be empty")
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if strings.Contains(level, "#") && (level != "#" || i != len(levels)-1) {
+			return fmt.Errorf("%s: # must be the last level on its own", filter)
+		}
+		if strings.Contains(level, "+") && level != "+" {
+			return fmt.Errorf("%s: + must be a level on its own", filter)
+		}
+	}
+	if strings.ContainsRune(filter, 0) {
+		return fmt.Errorf("%s: topic filter must not contain null characters", filter)
+	}
+	return nil
+}
+
+func configProblemsError(problems []error) error {
+	messages := make([]string, len(problems))
+	for i, problem := range problems {
+		messages[i] = "  - " + problem.Error()
+	}
+	return fmt.Errorf("Invalid adapter config:\n%s", strings.Join(messages, "\n"))
+}
+
+// runValidate implements the validate subcommand, which checks a config file, or the row in the adapter
+// config collection, without connecting to any broker
+func runValidate(args []string) int {
+	var configFile string
+	flag.StringVar(&configFile, "file", "", "JSON file containing an adapter config collection row, or just the adapter_settings object (optional)")
+	flag.Usage = func() {
+		log.Printf("Usage: mqttBridgeAdapter validate -file=<CONFIG_FILE>\n       mqttBridgeAdapter validate [options]\n\n")
+		flag.PrintDefaults()
+	}
+	flag.CommandLine.Parse(args)
+
+	var configData map[string]interface{}
+	if configFile != "" {
+		contents, err := ioutil.ReadFile(configFile)
+		if err != nil {
+			log.Printf("ERROR - Unable to read config file: %s\n", err.Error())
+			return 1
+		}
+		if err := json.Unmarshal(contents, &configData); err != nil {
+			log.Printf("ERROR - Unable to parse config file: %s\n", err.Error())
+			return 1
+		}
+		if _, ok := configData["adapter_settings"]; !ok {
+			configData = map[string]interface{}{"adapter_settings": configData}
+		}
+	} else {
+		// only the platform REST API is used to fetch the row
+		checkRequiredFlags()
+		client := newCbClient(parentCredentials())
+		if err := authenticateCbClient(client); err != nil {
+			log.Printf("ERROR - Unable to authenticate with ClearBlade: %s\n", err.Error())
+			return 1
+		}
+		row, err := fetchAdapterConfigRow(client)
+		if err != nil {
+			log.Printf("ERROR - %s\n", err.Error())
+			return 1
+		}
+		configData = row
+	}
+
+	newConfig, problems := parseAdapterConfig(configData)
+	problems, warnings := splitWarnings(problems)
+	for _, warning := range warnings {
+		log.Printf("WARN - %s\n", warning.Error())
+	}
+	if len(problems) > 0 {
+		log.Println(configProblemsError(problems).Error())
+		return 1
+	}
+	log.Printf("Adapter config is valid, version: %s\n", newConfig.Version)
+	return 0
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"hash/fnv"
+	"log"
+)
+
+const defaultWorkerQueueSize = 100
+
+var outgoingWorkers *workerPool
+
+// workerPoolConfig spreads outgoing messages over several workers. Messages with the same key are always
+// handled by the same worker, so they are published in the order they were received
+type workerPoolConfig struct {
+	Workers   int `json:"workers"`
+	QueueSize int `json:"queueSize"`
+	KeyLevel  int `json:"keyLevel"` // 1 based level of the outgoing topic used as the key, 0 to use the whole topic
+}
+
+type workerPool struct {
+	queues   []chan *bridgeMessage
+	keyLevel int
+	handler  func(*bridgeMessage)
+}
+
+// startOutgoingWorkers starts the outgoing worker pool if more than one worker is configured, otherwise
+// cbMessageListener handles messages itself. It is called by initCbClient once the config is loaded, so the pool
+// exists before the first message from ClearBlade is received, and is only started the first time
+func startOutgoingWorkers() {
+	if outgoingWorkers != nil {
+		return
+	}
+	settings := currentConfig().BrokerConfig.WorkerPool
+	if settings == nil || settings.Workers <= 1 {
+		return
+	}
+	queueSize := settings.QueueSize
+	if queueSize <= 0 {
+		queueSize = defaultWorkerQueueSize
+	}
+	log.Printf("[INFO] startOutgoingWorkers - Starting %d outgoing workers\n", settings.Workers)
+	outgoingWorkers = newWorkerPool(settings.Workers, queueSize, settings.KeyLevel, handleOutgoing)
+}
+
+func newWorkerPool(workers, queueSize, keyLevel int, handler func(*bridgeMessage)) *workerPool {
+	pool := &workerPool{
+		queues:   make([]chan *bridgeMessage, workers),
+		keyLevel: keyLevel,
+		handler:  handler,
+	}
+	for i := range pool.queues {
+		pool.queues[i] = make(chan *bridgeMessage, queueSize)
+		go pool.work(pool.queues[i])
+	}
+	return pool
+}
+
+func (p *workerPool) work(queue <-chan *bridgeMessage) {
+	for msg := range queue {
+		p.handler(msg)
+	}
+}
+
+// dispatch queues a message for the worker that owns its key, blocking while that worker's queue is full
+func (p *workerPool) dispatch(msg *bridgeMessage) {
+	key := msg.Topic
+	if p.keyLevel > 0 {
+		key = topicLevel(msg.Topic, p.keyLevel)
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	p.queues[hash.Sum32()%uint32(len(p.queues))] <- msg
+}
+
+// queueDepths returns the number of messages waiting in each worker's queue
+func (p *workerPool) queueDepths() []int {
+	depths := make([]int, len(p.queues))
+	for i, queue := range p.queues {
+		depths[i] = len(queue)
+	}
+	return depths
+}